@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"hash/fnv"
+	"reflect"
 
 	"github.com/BurntSushi/toml"
 )
@@ -10,13 +11,40 @@ import (
 // Shard describes a shard that holds the appropriate set of keys.
 // Each shard has unique set of keys.
 type Shard struct {
-	Name    string
-	Idx     int
-	Address string
+	Name     string
+	Idx      int
+	Address  string
+	Replicas []string
 }
 
+// Key distribution schemes.
+const (
+	// HashingModulo assigns the key to the shard by the key hash modulo shards count.
+	// Changing the shards count moves almost all keys.
+	HashingModulo = "modulo"
+	// HashingRing assigns the key to the shard using a consistent hash ring.
+	// Changing the shards count moves only about 1/N of the keys.
+	HashingRing = "ring"
+)
+
+// DefaultVirtualNodes is the number of points on the hash ring for each shard.
+const DefaultVirtualNodes = 128
+
+// EpochHeader is the HTTP header with the config epoch of the node that
+// sends a request to another node.
+const EpochHeader = "X-Distribkv-Epoch"
+
 // Config describes the sharding config.
 type Config struct {
+	// Epoch is the version of the config. It must be increased on every change
+	// so that the nodes with different configs do not route requests to each other.
+	Epoch int64
+
+	// Hashing is the key distribution scheme. Modulo hashing is used if it is empty.
+	Hashing string
+	// VirtualNodes is the number of points on the hash ring for each shard.
+	VirtualNodes int `toml:"virtual_nodes"`
+
 	Shards []Shard
 }
 
@@ -31,27 +59,82 @@ func ParseFile(filename string) (Config, error) {
 
 // Shards represents an easier-to-use representation of
 // the sharding config: the shards count, current index and
-// the addresses of all other shards too.
+// the addresses of all other shards and their replicas too.
 type Shards struct {
-	Count  int
-	CurIdx int
-	Addrs  map[int]string
+	Epoch    int64
+	Count    int
+	CurIdx   int
+	Addrs    map[int]string
+	Replicas map[int][]string
+
+	hashing string
+	ring    *ring
+}
+
+// ParseConfig converts and verifies the config into a form that
+// can be used for routing, including the key distribution scheme.
+func ParseConfig(c Config, curShardName string) (*Shards, error) {
+	s, err := ParseShards(c.Shards, curShardName)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Epoch = c.Epoch
+	s.hashing = c.Hashing
+	if s.hashing == "" {
+		s.hashing = HashingModulo
+	}
+
+	switch c.Hashing {
+	case "", HashingModulo:
+		if c.VirtualNodes != 0 {
+			return nil, fmt.Errorf("virtual_nodes can only be used with %q hashing", HashingRing)
+		}
+	case HashingRing:
+		vnodes := c.VirtualNodes
+		if vnodes == 0 {
+			vnodes = DefaultVirtualNodes
+		}
+		if vnodes < 0 {
+			return nil, fmt.Errorf("invalid number of virtual nodes: %d", vnodes)
+		}
+		s.hashing = fmt.Sprintf("%s with %d virtual nodes", HashingRing, vnodes)
+		s.ring = newRing(c.Shards, vnodes)
+	default:
+		return nil, fmt.Errorf("unknown hashing %q", c.Hashing)
+	}
+
+	return s, nil
 }
 
 // ParseShards converts and verifies the list of shards
 // specified in the config into a form that can be used
-// for routing.
+// for routing. The empty curShardName is used for the config
+// the current node is not part of, and CurIdx is -1 then.
 func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
 	shardCount := len(shards)
 	shardIdx := -1
 	addrs := make(map[int]string)
+	replicas := make(map[int][]string)
+	seenAddrs := make(map[string]bool)
 
 	for _, s := range shards {
 		if _, ok := addrs[s.Idx]; ok {
 			return nil, fmt.Errorf("duplicate shard index: %d", s.Idx)
 		}
 
+		for _, a := range append([]string{s.Address}, s.Replicas...) {
+			if a == "" {
+				return nil, fmt.Errorf("shard %q has an empty address", s.Name)
+			}
+			if seenAddrs[a] {
+				return nil, fmt.Errorf("duplicate address %q in shard %q", a, s.Name)
+			}
+			seenAddrs[a] = true
+		}
+
 		addrs[s.Idx] = s.Address
+		replicas[s.Idx] = s.Replicas
 		if s.Name == curShardName {
 			shardIdx = s.Idx
 		}
@@ -63,20 +146,87 @@ func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
 		}
 	}
 
-	if shardIdx < 0 {
+	if shardIdx < 0 && curShardName != "" {
 		return nil, fmt.Errorf("shard %q was not found", curShardName)
 	}
 
 	return &Shards{
-		Addrs:  addrs,
-		Count:  shardCount,
-		CurIdx: shardIdx,
+		Addrs:    addrs,
+		Replicas: replicas,
+		Count:    shardCount,
+		CurIdx:   shardIdx,
 	}, nil
 }
 
+// SamePlacement reports whether the keys are assigned to the same shard
+// addresses in both configs.
+func (s *Shards) SamePlacement(o *Shards) bool {
+	return s.Count == o.Count && s.hashing == o.hashing &&
+		reflect.DeepEqual(s.Addrs, o.Addrs) && reflect.DeepEqual(s.ring, o.ring)
+}
+
+// IsReplica reports whether addr is the address of one of the replicas of the shard.
+func (s *Shards) IsReplica(shard int, addr string) bool {
+	for _, a := range s.Replicas[shard] {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
 // Index returns the shard number for the corresponding key.
 func (s *Shards) Index(key string) int {
+	if s.ring != nil {
+		return s.ring.index(key)
+	}
+
 	h := fnv.New64()
 	h.Write([]byte(key))
 	return int(h.Sum64() % uint64(s.Count))
 }
+
+// NamespaceIndex returns the shard number for the key in the namespace.
+// The keys of the default namespace are placed exactly like with Index,
+// and the keys of the other namespaces are hashed together with the namespace.
+func (s *Shards) NamespaceIndex(ns, key string) int {
+	if ns == "" {
+		return s.Index(key)
+	}
+	return s.Index(ns + "\x00" + key)
+}
+
+// Changes describes the differences between the old and the new config
+// in a human-readable form.
+func Changes(old, new *Shards) []string {
+	var res []string
+
+	if old.Epoch != new.Epoch {
+		res = append(res, fmt.Sprintf("epoch: %d -> %d", old.Epoch, new.Epoch))
+	}
+	if old.hashing != new.hashing {
+		res = append(res, fmt.Sprintf("hashing: %q -> %q", old.hashing, new.hashing))
+	}
+	if old.Count != new.Count {
+		res = append(res, fmt.Sprintf("shard count: %d -> %d", old.Count, new.Count))
+	}
+	if old.CurIdx != new.CurIdx {
+		res = append(res, fmt.Sprintf("current shard: %d -> %d", old.CurIdx, new.CurIdx))
+	}
+
+	count := old.Count
+	if new.Count > count {
+		count = new.Count
+	}
+
+	for i := 0; i < count; i++ {
+		if old.Addrs[i] != new.Addrs[i] {
+			res = append(res, fmt.Sprintf("shard %d address: %q -> %q", i, old.Addrs[i], new.Addrs[i]))
+		}
+		if !reflect.DeepEqual(old.Replicas[i], new.Replicas[i]) {
+			res = append(res, fmt.Sprintf("shard %d replicas: %q -> %q", i, old.Replicas[i], new.Replicas[i]))
+		}
+	}
+
+	return res
+}
@@ -1,6 +1,7 @@
 package config_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
@@ -38,14 +39,16 @@ func TestConfigParse(t *testing.T) {
 	got := createConfig(t, `[[shards]]
 		name = "Moscow"
 		idx = 0
-		address = "localhost:8080"`)
+		address = "localhost:8080"
+		replicas = ["localhost:8090"]`)
 
 	want := config.Config{
 		Shards: []config.Shard{
 			{
-				Name:    "Moscow",
-				Idx:     0,
-				Address: "localhost:8080",
+				Name:     "Moscow",
+				Idx:      0,
+				Address:  "localhost:8080",
+				Replicas: []string{"localhost:8090"},
 			},
 		},
 	}
@@ -64,7 +67,8 @@ func TestParseShards(t *testing.T) {
 	[[shards]]
 		name = "Minsk"
 		idx = 1
-		address = "localhost:8081"`)
+		address = "localhost:8081"
+		replicas = ["localhost:8091", "localhost:8092"]`)
 
 	got, err := config.ParseShards(c.Shards, "Minsk")
 	if err != nil {
@@ -78,9 +82,191 @@ func TestParseShards(t *testing.T) {
 			0: "localhost:8080",
 			1: "localhost:8081",
 		},
+		Replicas: map[int][]string{
+			0: nil,
+			1: {"localhost:8091", "localhost:8092"},
+		},
 	}
 
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("The shards config does match: got: %#v, want: %#v", got, want)
 	}
 }
+
+func TestParseShardsDuplicateAddress(t *testing.T) {
+	c := createConfig(t, `
+	[[shards]]
+		name = "Moscow"
+		idx = 0
+		address = "localhost:8080"
+	[[shards]]
+		name = "Minsk"
+		idx = 1
+		address = "localhost:8081"
+		replicas = ["localhost:8080"]`)
+
+	if _, err := config.ParseShards(c.Shards, "Minsk"); err == nil {
+		t.Errorf("ParseShards(): got nil error for a replica with a leader address, want non-nil error")
+	}
+}
+
+func ringConfig(shardCount int) config.Config {
+	c := config.Config{Hashing: config.HashingRing}
+	for i := 0; i < shardCount; i++ {
+		c.Shards = append(c.Shards, config.Shard{
+			Name:    fmt.Sprintf("shard-%d", i),
+			Idx:     i,
+			Address: fmt.Sprintf("localhost:%d", 8080+i),
+		})
+	}
+	return c
+}
+
+func TestRingMovesFewKeys(t *testing.T) {
+	before, err := config.ParseConfig(ringConfig(4), "shard-0")
+	if err != nil {
+		t.Fatalf("ParseConfig() with 4 shards: %v", err)
+	}
+
+	after, err := config.ParseConfig(ringConfig(5), "shard-0")
+	if err != nil {
+		t.Fatalf("ParseConfig() with 5 shards: %v", err)
+	}
+
+	const keys = 10000
+	moved := 0
+	perShard := make(map[int]int)
+
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		idx := after.Index(key)
+		perShard[idx]++
+
+		if prev := before.Index(key); prev != idx {
+			moved++
+			if idx != 4 {
+				t.Fatalf("Key %q moved from shard %d to shard %d, want keys to move only to the new shard", key, prev, idx)
+			}
+		}
+	}
+
+	// About 1/5 of the keys are expected to move.
+	if moved > keys*3/10 {
+		t.Errorf("Too many keys moved after adding a shard: got %d of %d", moved, keys)
+	}
+
+	for idx := 0; idx < 5; idx++ {
+		if n := perShard[idx]; n < keys/10 || n > keys*3/10 {
+			t.Errorf("Uneven distribution: shard %d got %d keys of %d", idx, n, keys)
+		}
+	}
+}
+
+func TestParseConfigHashing(t *testing.T) {
+	c := createConfig(t, `
+	[[shards]]
+		name = "Moscow"
+		idx = 0
+		address = "localhost:8080"
+	[[shards]]
+		name = "Minsk"
+		idx = 1
+		address = "localhost:8081"`)
+
+	s, err := config.ParseConfig(c, "Moscow")
+	if err != nil {
+		t.Fatalf("ParseConfig(): %v", err)
+	}
+
+	// Modulo hashing is used by default; calculated manually.
+	if got := s.Index("Soviet"); got != 1 {
+		t.Errorf(`Index("Soviet"): got %d, want %d`, got, 1)
+	}
+
+	// The keys of the default namespace stay where they were.
+	if got := s.NamespaceIndex("", "Soviet"); got != 1 {
+		t.Errorf(`NamespaceIndex("", "Soviet"): got %d, want %d`, got, 1)
+	}
+	if got, want := s.NamespaceIndex("team", "Soviet"), s.Index("team\x00Soviet"); got != want {
+		t.Errorf(`NamespaceIndex("team", "Soviet"): got %d, want %d`, got, want)
+	}
+
+	ring := createConfig(t, `
+	hashing = "ring"
+	virtual_nodes = 16
+	[[shards]]
+		name = "Moscow"
+		idx = 0
+		address = "localhost:8080"`)
+
+	if ring.Hashing != config.HashingRing || ring.VirtualNodes != 16 {
+		t.Errorf("Unexpected hashing settings: got %q, %d; want %q, %d", ring.Hashing, ring.VirtualNodes, config.HashingRing, 16)
+	}
+
+	c.Hashing = "bogus"
+	if _, err := config.ParseConfig(c, "Moscow"); err == nil {
+		t.Errorf("ParseConfig() with unknown hashing: got nil error, want non-nil error")
+	}
+}
+
+func TestChanges(t *testing.T) {
+	old, err := config.ParseConfig(ringConfig(2), "shard-0")
+	if err != nil {
+		t.Fatalf("ParseConfig(): %v", err)
+	}
+
+	c := ringConfig(3)
+	c.Shards[1].Address = "localhost:9000"
+	c.Shards[1].Replicas = []string{"localhost:9001"}
+
+	new, err := config.ParseConfig(c, "shard-0")
+	if err != nil {
+		t.Fatalf("ParseConfig(): %v", err)
+	}
+
+	got := config.Changes(old, new)
+	want := []string{
+		`shard count: 2 -> 3`,
+		`shard 1 address: "localhost:8081" -> "localhost:9000"`,
+		`shard 1 replicas: [] -> ["localhost:9001"]`,
+		`shard 2 address: "" -> "localhost:8082"`,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Changes(): got %q, want %q", got, want)
+	}
+
+	if got := config.Changes(new, new); len(got) != 0 {
+		t.Errorf("Changes() for the same config: got %q, want no changes", got)
+	}
+}
+
+func TestSamePlacement(t *testing.T) {
+	old, err := config.ParseConfig(ringConfig(2), "shard-0")
+	if err != nil {
+		t.Fatalf("ParseConfig(): %v", err)
+	}
+
+	c := ringConfig(2)
+	c.Epoch = 2
+	c.Shards[1].Replicas = []string{"localhost:9001"}
+	same, err := config.ParseConfig(c, "shard-1")
+	if err != nil {
+		t.Fatalf("ParseConfig(): %v", err)
+	}
+	if !old.SamePlacement(same) {
+		t.Errorf("SamePlacement() with new epoch and replicas: got false, want true")
+	}
+
+	// The config the current node is not part of.
+	added, err := config.ParseConfig(ringConfig(3), "")
+	if err != nil {
+		t.Fatalf(`ParseConfig() with empty shard name: %v`, err)
+	}
+	if added.CurIdx != -1 {
+		t.Errorf(`ParseConfig() with empty shard name: got CurIdx %d, want -1`, added.CurIdx)
+	}
+	if old.SamePlacement(added) {
+		t.Errorf("SamePlacement() with an added shard: got true, want false")
+	}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring with several virtual nodes per shard.
+type ring struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// newRing places vnodes points for each shard on the ring.
+// The points depend on the shard names, so adding or removing a shard
+// only moves the keys that are adjacent to its points.
+func newRing(shards []Shard, vnodes int) *ring {
+	r := &ring{points: make([]ringPoint, 0, len(shards)*vnodes)}
+
+	for _, s := range shards {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{
+				hash:  hashString(s.Name + "#" + strconv.Itoa(i)),
+				shard: s.Idx,
+			})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].shard < r.points[j].shard
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+// index returns the shard that owns the first point following the key on the ring.
+func (r *ring) index(key string) int {
+	h := hashString(key)
+
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].shard
+}
+
+// hashString returns the FNV hash of s with the bits mixed so that
+// similar strings get evenly distributed on the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
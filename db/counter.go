@@ -0,0 +1,64 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var (
+	// ErrNotInteger is returned by Increment when the current value
+	// of the key is not a decimal integer.
+	ErrNotInteger = errors.New("value is not an integer")
+	// ErrOverflow is returned by Increment when the result does not fit into int64.
+	ErrOverflow = errors.New("integer overflow")
+)
+
+// Increment atomically adds delta to the integer value of the key and
+// returns the resulting value with the new metadata of the key.
+// The value is stored as a decimal string, and the missing or expired keys
+// are treated as zero. The content type and the expiration time of the key
+// are kept. The change is appended to the replication log as the resulting
+// value, so the replicas store the same value as the leader.
+func (d *Database) Increment(key string, delta int64) (int64, Meta, error) {
+	if d.readOnly {
+		return 0, Meta{}, ErrReadOnly
+	}
+
+	var res int64
+	var m Meta
+	err := d.db.Update(func(tx txn) error {
+		ns, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		current, meta, err := ns.get(key)
+		if err != nil {
+			return err
+		}
+
+		var n int64
+		if current != nil {
+			if n, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+				return fmt.Errorf("%w: %q", ErrNotInteger, current)
+			}
+		}
+
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return fmt.Errorf("%w: %d%+d", ErrOverflow, n, delta)
+		}
+		res = n + delta
+
+		meta.Modified = now()
+		m, err = ns.set(key, []byte(strconv.FormatInt(res, 10)), meta)
+		return err
+	})
+	if err != nil {
+		return 0, Meta{}, err
+	}
+
+	d.notifyChanged()
+	return res, m, nil
+}
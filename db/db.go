@@ -4,28 +4,62 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-
-	bolt "go.etcd.io/bbolt"
+	"time"
 )
 
 var defaultBucket = []byte("default")
-var replicaBucket = []byte("replication")
 
-// Database is an open bolt database.
+// ErrReadOnly is returned for writes to a read-only replica.
+var ErrReadOnly = errors.New("read-only mode")
+
+// ErrConditionFailed is returned for conditional writes when
+// the current value of the key does not satisfy the condition.
+var ErrConditionFailed = errors.New("condition failed")
+
+// KeyValue is a key together with its value and metadata.
+type KeyValue struct {
+	Key   string
+	Value []byte
+	Meta  Meta
+}
+
+// Database is an open database with its storage engine.
+// It operates on the keys of a single namespace, the default one
+// unless the Database is returned by In.
 type Database struct {
-	db       *bolt.DB
+	db       engine
 	readOnly bool
+	ns       string
+	changes  *changes
 }
 
 // NewDatabase returns an instance of a database that we can work with.
+// The keys are stored in the bolt database at dbPath.
 func NewDatabase(dbPath string, readOnly bool) (db *Database, closeFunc func() error, err error) {
-	boltDb, err := bolt.Open(dbPath, 0600, nil)
+	return Open(EngineBolt, dbPath, readOnly)
+}
+
+// Open opens the database with the storage engine.
+// The path is the bolt database file or the log file of the log engine,
+// and it is not used by the memory engine.
+func Open(e Engine, path string, readOnly bool) (db *Database, closeFunc func() error, err error) {
+	var storage engine
+	switch e {
+	case EngineBolt:
+		storage, err = openBolt(path)
+	case EngineMemory:
+		storage = newMemoryEngine()
+	case EngineLog:
+		storage, err = openLog(path)
+	default:
+		err = fmt.Errorf("unknown storage engine %q", e)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
-	db = &Database{db: boltDb, readOnly: readOnly}
-	closeFunc = boltDb.Close
+	db = &Database{db: storage, readOnly: readOnly, changes: &changes{ch: make(chan struct{})}}
+	closeFunc = storage.Close
 
 	if err := db.createBuckets(); err != nil {
 		closeFunc()
@@ -36,39 +70,149 @@ func NewDatabase(dbPath string, readOnly bool) (db *Database, closeFunc func() e
 }
 
 func (d *Database) createBuckets() error {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(defaultBucket); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists(replicaBucket); err != nil {
-			return err
+	return d.db.Update(func(tx txn) error {
+		for _, name := range [][]byte{defaultBucket, metaBucket, expiryBucket, namespacesBucket, logBucket, replicasBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 }
 
-// SetKey sets the key to the requested value into the default database or returns an error.
+// Condition is the requirement for the current value of the key in conditional writes.
+// The zero Condition is always satisfied. The expired keys do not exist.
+type Condition struct {
+	// IfAbsent requires the key to not exist.
+	IfAbsent bool
+	// IfExists requires the key to exist.
+	IfExists bool
+	// IfValue requires the key to have the value unless it is nil.
+	IfValue []byte
+	// IfETag requires the key to have the ETag of its version unless it is empty.
+	IfETag string
+}
+
+// IsZero reports whether the condition is always satisfied.
+func (c Condition) IsZero() bool {
+	return !c.IfAbsent && !c.IfExists && c.IfValue == nil && c.IfETag == ""
+}
+
+func (c Condition) check(n *namespace, key string) error {
+	if c.IsZero() {
+		return nil
+	}
+
+	current, m, err := n.get(key)
+	if err != nil {
+		return err
+	}
+	exists := current != nil
+
+	switch {
+	case c.IfAbsent && exists:
+		return fmt.Errorf("%w: the key exists", ErrConditionFailed)
+	case (c.IfExists || c.IfValue != nil || c.IfETag != "") && !exists:
+		return fmt.Errorf("%w: the key does not exist", ErrConditionFailed)
+	case c.IfValue != nil && !bytes.Equal(current, c.IfValue):
+		return fmt.Errorf("%w: the value is different", ErrConditionFailed)
+	}
+
+	if c.IfETag != "" && m.ETag() != c.IfETag {
+		return fmt.Errorf("%w: the ETag is different", ErrConditionFailed)
+	}
+	return nil
+}
+
+// SetOptions are the optional parameters of SetKeyWith.
+type SetOptions struct {
+	// Condition is checked in the same transaction as the write.
+	Condition Condition
+	// ContentType is stored in the metadata of the key.
+	ContentType string
+	// TTL makes the key expire after the duration unless it is zero.
+	TTL time.Duration
+}
+
+// SetKey sets the key to the requested value into the namespace or returns an error.
+// The change is appended to the replication log.
 func (d *Database) SetKey(key string, value []byte) error {
+	_, err := d.SetKeyWith(key, value, SetOptions{})
+	return err
+}
+
+// SetKeyIf sets the key to the requested value if the current value satisfies
+// the condition, or returns ErrConditionFailed otherwise. The condition is
+// checked in the same transaction as the write. The change is appended to the replication log.
+func (d *Database) SetKeyIf(key string, value []byte, cond Condition) error {
+	_, err := d.SetKeyWith(key, value, SetOptions{Condition: cond})
+	return err
+}
+
+// SetKeyWith sets the key to the requested value with the options and
+// returns the new metadata of the key. The change is appended to the replication log.
+func (d *Database) SetKeyWith(key string, value []byte, opts SetOptions) (Meta, error) {
 	if d.readOnly {
-		return errors.New("read-only mode")
+		return Meta{}, ErrReadOnly
 	}
 
-	return d.db.Update(func(tx *bolt.Tx) error {
-		if err := tx.Bucket(defaultBucket).Put([]byte(key), value); err != nil {
+	var m Meta
+	err := d.db.Update(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		if err := opts.Condition.check(n, key); err != nil {
 			return err
 		}
 
-		return tx.Bucket(replicaBucket).Put([]byte(key), value)
+		m = Meta{Modified: now(), ContentType: opts.ContentType}
+		if opts.TTL > 0 {
+			m.Expires = m.Modified.Add(opts.TTL)
+		}
+
+		m, err = n.set(key, value, m)
+		return err
 	})
+	if err != nil {
+		return Meta{}, err
+	}
+
+	d.notifyChanged()
+	return m, nil
+}
+
+// DeleteKey deletes the key from the namespace or returns an error.
+// The deletion is appended to the replication log.
+func (d *Database) DeleteKey(key string) error {
+	return d.DeleteKeyIf(key, Condition{})
 }
 
-// SetKeyOnReplica sets the key to the requested value into the default database and does not write
-// to the replication queue.
-// This method is intended to be used only on replicas.
-func (d *Database) SetKeyOnReplica(key string, value []byte) error {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(defaultBucket).Put([]byte(key), value)
+// DeleteKeyIf deletes the key if the current value satisfies the condition,
+// or returns ErrConditionFailed otherwise. The deletion is appended to the replication log.
+func (d *Database) DeleteKeyIf(key string, cond Condition) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	err := d.db.Update(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		if err := cond.check(n, key); err != nil {
+			return err
+		}
+		return n.delete(key)
 	})
+	if err != nil {
+		return err
+	}
+
+	d.notifyChanged()
+	return nil
 }
 
 func copyByteSlice(b []byte) []byte {
@@ -80,66 +224,115 @@ func copyByteSlice(b []byte) []byte {
 	return res
 }
 
-// GetNextKeyForReplication returns the key and value for the keys that have
-// changed and have not yet been applied to replicas.
-// If there are no new keys, nil key and value will be returned.
-func (d *Database) GetNextKeyForReplication() (key, value []byte, err error) {
-	err = d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicaBucket)
-		k, v := b.Cursor().First()
-		key = copyByteSlice(k)
-		value = copyByteSlice(v)
-		return nil
+// GetKey get the value of the requested from the namespace.
+// The value is nil if the key does not exist or has expired.
+func (d *Database) GetKey(key string) ([]byte, error) {
+	var result []byte
+	err := d.db.View(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		value, _, err := n.get(key)
+		result = copyByteSlice(value)
+		return err
 	})
 
-	if err != nil {
-		return nil, nil, err
+	if err == nil {
+		return result, nil
 	}
-
-	return key, value, nil
+	return nil, err
 }
 
-// DeleteReplicationKey deletes the key from the replication queue
-// if the value matches the contents or if the key is already absent.
-func (d *Database) DeleteReplicationKey(key, value []byte) (err error) {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicaBucket)
+// GetKeys returns the values of the keys with their metadata from a single
+// snapshot of the database. The value is nil for the keys that do not exist
+// or have expired.
+func (d *Database) GetKeys(keys []string) ([]KeyValue, error) {
+	res := make([]KeyValue, len(keys))
 
-		v := b.Get(key)
-		if v == nil {
-			return errors.New("key does not exist")
+	err := d.db.View(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
 		}
 
-		if !bytes.Equal(v, value) {
-			return errors.New("value does not match")
+		for i, k := range keys {
+			value, m, err := n.get(k)
+			if err != nil {
+				return err
+			}
+			res[i] = KeyValue{Key: k, Value: copyByteSlice(value), Meta: m}
 		}
-
-		return b.Delete(key)
+		return nil
 	})
+
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
-// GetKey get the value of the requested from a default database.
-func (d *Database) GetKey(key string) ([]byte, error) {
-	var result []byte
-	err := d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
-		result = copyByteSlice(b.Get([]byte(key)))
+// Scan returns up to limit keys with the prefix from the [start, end) range
+// together with their values and metadata in the key order. An empty end means that the range
+// is not limited and a non-positive limit returns all keys.
+// The next key is the first key that did not fit into the limit and can be used
+// as the start of the next page. It is empty if there are no more keys.
+// The expired keys are skipped.
+func (d *Database) Scan(prefix, start, end string, limit int) (kvs []KeyValue, next string, err error) {
+	if start < prefix {
+		start = prefix
+	}
+
+	err = d.db.View(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		c := n.data.Cursor()
+		t := now()
+
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if !bytes.HasPrefix(k, []byte(prefix)) || (end != "" && string(k) >= end) {
+				break
+			}
+
+			m, err := n.getMeta(string(k))
+			if err != nil {
+				return err
+			}
+			if m.Expired(t) {
+				continue
+			}
+
+			if limit > 0 && len(kvs) == limit {
+				next = string(k)
+				break
+			}
+
+			kvs = append(kvs, KeyValue{Key: string(k), Value: copyByteSlice(v), Meta: m})
+		}
 		return nil
 	})
 
-	if err == nil {
-		return result, nil
+	if err != nil {
+		return nil, "", err
 	}
-	return nil, err
+	return kvs, next, nil
 }
 
-// DeleteExtraKeys deletes the keys that do not belong to this shard.
-func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
+// ExtraKeys returns the keys that do not belong to this shard.
+func (d *Database) ExtraKeys(isExtra func(string) bool) ([]string, error) {
 	var keys []string
 
-	err := d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
-		return b.ForEach(func(k, v []byte) error {
+	err := d.db.View(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		return n.data.ForEach(func(k, v []byte) error {
 			ks := string(k)
 			if isExtra(ks) {
 				keys = append(keys, ks)
@@ -148,18 +341,140 @@ func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
 		})
 	})
 
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteExtraKeys deletes the keys that do not belong to this shard.
+// The deletions are appended to the replication log.
+func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	keys, err := d.ExtraKeys(isExtra)
 	if err != nil {
 		return err
 	}
 
-	return d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
+	return d.DeleteKeys(keys)
+}
+
+// DeleteKeys deletes the keys in a single transaction.
+// The deletions are appended to the replication log.
+func (d *Database) DeleteKeys(keys []string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err := d.db.Update(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
 
 		for _, k := range keys {
-			if err := b.Delete([]byte(k)); err != nil {
+			if err := n.delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.notifyChanged()
+	return nil
+}
+
+// SetKeys sets the keys to the requested values in a single transaction.
+// The content type and the expiration time are taken from the metadata of the values.
+// The changes are appended to the replication log.
+func (d *Database) SetKeys(kvs []KeyValue) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(kvs) == 0 {
+		return nil
+	}
+
+	err := d.db.Update(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		modified := now()
+		for _, kv := range kvs {
+			m := Meta{Modified: modified, ContentType: kv.Meta.ContentType, Expires: kv.Meta.Expires}
+			if _, err := n.set(kv.Key, kv.Value, m); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	d.notifyChanged()
+	return nil
+}
+
+// SetKeysIfAbsent sets the keys that are not present in the database yet
+// in a single transaction. The content type, the modification and the expiration
+// time are taken from the metadata of the values, and the new versions are greater
+// than the provided ones, so the versions of the moved keys keep growing.
+// The changes are appended to the replication log.
+func (d *Database) SetKeysIfAbsent(kvs []KeyValue) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	err := d.db.Update(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		log := tx.Bucket(logBucket)
+		for _, kv := range kvs {
+			current, _, err := n.get(kv.Key)
+			if err != nil {
+				return err
+			} else if current != nil {
+				continue
+			}
+
+			if kv.Meta.Version > log.Sequence() {
+				if err := log.SetSequence(kv.Meta.Version); err != nil {
+					return err
+				}
+			}
+
+			m := kv.Meta
+			if m.Modified.IsZero() {
+				m.Modified = now()
+			}
+
+			if _, err := n.set(kv.Key, kv.Value, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.notifyChanged()
+	return nil
 }
@@ -2,14 +2,30 @@ package db_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/YuriyNasretdinov/distribkv/db"
 )
 
-func createTempDb(t *testing.T, readOnly bool) *db.Database {
+// engines are the storage engines that every test runs against.
+var engines = []db.Engine{db.EngineBolt, db.EngineMemory, db.EngineLog}
+
+// forEachEngine runs the test against every storage engine.
+func forEachEngine(t *testing.T, test func(t *testing.T, engine db.Engine)) {
+	for _, e := range engines {
+		t.Run(string(e), func(t *testing.T) { test(t, e) })
+	}
+}
+
+func createTempDb(t *testing.T, engine db.Engine, readOnly bool) *db.Database {
 	t.Helper()
 
 	f, err := ioutil.TempFile(os.TempDir(), "kvdb")
@@ -20,7 +36,7 @@ func createTempDb(t *testing.T, readOnly bool) *db.Database {
 	f.Close()
 	t.Cleanup(func() { os.Remove(name) })
 
-	db, closeFunc, err := db.NewDatabase(name, readOnly)
+	db, closeFunc, err := db.Open(engine, name, readOnly)
 	if err != nil {
 		t.Fatalf("Could not create a new database: %v", err)
 	}
@@ -29,8 +45,30 @@ func createTempDb(t *testing.T, readOnly bool) *db.Database {
 	return db
 }
 
-func TestGetSet(t *testing.T) {
-	db := createTempDb(t, false)
+func setReplicas(t *testing.T, d db.Store, names ...string) {
+	t.Helper()
+
+	if err := d.SetReplicas(names); err != nil {
+		t.Fatalf("SetReplicas(%q) failed: %v", names, err)
+	}
+}
+
+func nextEntry(t *testing.T, d db.Store, after uint64) *db.LogEntry {
+	t.Helper()
+
+	e, err := d.GetNextKeyForReplication(after)
+	if err != nil {
+		t.Fatalf("Unexpected error for GetNextKeyForReplication(%d): %v", after, err)
+	}
+
+	return e
+}
+
+func TestGetSet(t *testing.T) { forEachEngine(t, testGetSet) }
+
+func testGetSet(t *testing.T, engine db.Engine) {
+	db := createTempDb(t, engine, false)
+	setReplicas(t, db, "replica")
 
 	if err := db.SetKey("party", []byte("Great")); err != nil {
 		t.Fatalf("Could not write key: %v", err)
@@ -45,57 +83,284 @@ func TestGetSet(t *testing.T) {
 		t.Errorf(`Unexpected value for key "party": got %q, want %q`, value, "Great")
 	}
 
-	k, v, err := db.GetNextKeyForReplication()
+	e := nextEntry(t, db, 0)
+	if e == nil || e.Key != "party" || !bytes.Equal(e.Value, []byte("Great")) {
+		t.Errorf(`GetNextKeyForReplication(0): got %+v; want %q, %q`, e, "party", "Great")
+	}
+}
+
+func TestReplicationLogOrder(t *testing.T) { forEachEngine(t, testReplicationLogOrder) }
+
+func testReplicationLogOrder(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "replica")
+
+	setKey(t, d, "party", "Great")
+	setKey(t, d, "party", "Bad")
+	setKey(t, d, "a", "First")
+
+	want := []db.LogEntry{
+		{Seq: 1, Op: db.OpSet, Key: "party", Value: []byte("Great")},
+		{Seq: 2, Op: db.OpSet, Key: "party", Value: []byte("Bad")},
+		{Seq: 3, Op: db.OpSet, Key: "a", Value: []byte("First")},
+	}
+
+	var after uint64
+	for _, w := range want {
+		got := nextEntry(t, d, after)
+		if got == nil || got.Modified.IsZero() {
+			t.Fatalf("GetNextKeyForReplication(%d): got %+v; want an entry with the modification time", after, got)
+		}
+
+		w.Modified = got.Modified
+		if !reflect.DeepEqual(*got, w) {
+			t.Fatalf("GetNextKeyForReplication(%d): got %+v; want %+v", after, got, w)
+		}
+		after = got.Seq
+	}
+
+	if got := nextEntry(t, d, after); got != nil {
+		t.Errorf("GetNextKeyForReplication(%d): got %+v; want nil", after, got)
+	}
+}
+
+func TestGetNextKeysForReplication(t *testing.T) { forEachEngine(t, testGetNextKeysForReplication) }
+
+func testGetNextKeysForReplication(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "replica")
+
+	setKey(t, d, "party", "Great")
+	setKey(t, d, "us", "CapitalistPigs")
+	setKey(t, d, "a", "First")
+
+	entries, err := d.GetNextKeysForReplication(0, 2, 0)
 	if err != nil {
-		t.Fatalf(`Unexpected error for GetNextKeyForReplication(): %v`, err)
+		t.Fatalf("GetNextKeysForReplication(0, 2, 0): %v", err)
 	}
 
-	if !bytes.Equal(k, []byte("party")) || !bytes.Equal(v, []byte("Great")) {
-		t.Errorf(`GetNextKeyForReplication(): got %q, %q; want %q, %q`, k, v, "party", "Great")
+	if len(entries) != 2 || entries[0].Seq != 1 || entries[1].Seq != 2 {
+		t.Errorf("GetNextKeysForReplication(0, 2, 0): got %+v, want entries 1 and 2", entries)
+	}
+
+	// The first entry does not fit into the byte limit but is still returned.
+	entries, err = d.GetNextKeysForReplication(1, 10, 1)
+	if err != nil {
+		t.Fatalf("GetNextKeysForReplication(1, 10, 1): %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].Key != "us" {
+		t.Errorf("GetNextKeysForReplication(1, 10, 1): got %+v, want only the entry for %q", entries, "us")
+	}
+
+	replica := createTempDb(t, engine, true)
+
+	entries, err = d.GetNextKeysForReplication(0, 10, 0)
+	if err != nil {
+		t.Fatalf("GetNextKeysForReplication(0, 10, 0): %v", err)
+	}
+
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	for key, want := range map[string]string{"party": "Great", "us": "CapitalistPigs", "a": "First"} {
+		if value := getKey(t, replica, key); value != want {
+			t.Errorf("Unexpected value for key %q on replica: got %q, want %q", key, value, want)
+		}
+	}
+
+	if seq, err := replica.AppliedSeq(); err != nil || seq != 3 {
+		t.Errorf("AppliedSeq(): got %d, %v; want %d, nil", seq, err, 3)
 	}
 }
 
-func TestDeleteReplicationKey(t *testing.T) {
-	db := createTempDb(t, false)
+func TestAckReplication(t *testing.T) { forEachEngine(t, testAckReplication) }
 
-	setKey(t, db, "party", "Great")
+func testAckReplication(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+
+	if err := d.AckReplication("first", 1); err == nil {
+		t.Fatalf(`AckReplication("first", 1) for unregistered replica: got nil error, want non-nil error`)
+	}
+
+	setReplicas(t, d, "first", "second")
+
+	setKey(t, d, "party", "Great")
+	setKey(t, d, "us", "CapitalistPigs")
+
+	if err := d.AckReplication("first", 2); err != nil {
+		t.Fatalf(`AckReplication("first", 2): got %q, want nil error`, err)
+	}
+
+	if e := nextEntry(t, d, 0); e == nil || e.Seq != 1 {
+		t.Fatalf("GetNextKeyForReplication(0) after the first replica ack: got %+v, want entry 1", e)
+	}
+
+	if err := d.AckReplication("second", 1); err != nil {
+		t.Fatalf(`AckReplication("second", 1): got %q, want nil error`, err)
+	}
+
+	if e := nextEntry(t, d, 1); e == nil || e.Seq != 2 {
+		t.Fatalf("GetNextKeyForReplication(1) after both replicas acked entry 1: got %+v, want entry 2", e)
+	}
+
+	if _, err := d.GetNextKeyForReplication(0); !errors.Is(err, db.ErrLogTruncated) {
+		t.Fatalf("GetNextKeyForReplication(0) after both replicas acked entry 1: got %v, want %v", err, db.ErrLogTruncated)
+	}
+
+	// The removed replica must not hold the changes anymore.
+	setReplicas(t, d, "first")
+
+	if err := d.AckReplication("second", 2); err == nil {
+		t.Fatalf(`AckReplication("second", 2) for removed replica: got nil error, want non-nil error`)
+	}
+
+	if err := d.AckReplication("first", 2); err != nil {
+		t.Fatalf(`AckReplication("first", 2): got %q, want nil error`, err)
+	}
+
+	if e := nextEntry(t, d, 2); e != nil {
+		t.Fatalf("GetNextKeyForReplication(2) after all acks: got %+v, want nil", e)
+	}
+}
+
+func TestReplicationLogTruncated(t *testing.T) { forEachEngine(t, testReplicationLogTruncated) }
+
+func testReplicationLogTruncated(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "first")
+
+	setKey(t, d, "a", "First")
+	setKey(t, d, "b", "Second")
+	if err := d.AckReplication("first", 2); err != nil {
+		t.Fatalf(`AckReplication("first", 2): %v`, err)
+	}
+	setKey(t, d, "c", "Third")
+
+	// The replica added after the changes were removed cannot get them.
+	setReplicas(t, d, "first", "second")
+
+	if _, err := d.GetNextKeysForReplication(0, 10, 0); !errors.Is(err, db.ErrLogTruncated) {
+		t.Errorf("GetNextKeysForReplication(0, 10, 0) for the new replica: got %v, want %v", err, db.ErrLogTruncated)
+	}
+	if e := nextEntry(t, d, 2); e == nil || e.Key != "c" {
+		t.Errorf("GetNextKeyForReplication(2): got %+v, want the entry for %q", e, "c")
+	}
+
+	// Without replicas the changes are not kept.
+	setReplicas(t, d)
+	setKey(t, d, "d", "Fourth")
+
+	if _, err := d.GetNextKeysForReplication(2, 10, 0); !errors.Is(err, db.ErrLogTruncated) {
+		t.Errorf("GetNextKeysForReplication(2, 10, 0) without replicas: got %v, want %v", err, db.ErrLogTruncated)
+	}
+	if e := nextEntry(t, d, 4); e != nil {
+		t.Errorf("GetNextKeyForReplication(4) without replicas: got %+v, want nil", e)
+	}
+}
+
+func TestApplyLogEntry(t *testing.T) { forEachEngine(t, testApplyLogEntry) }
 
-	k, v, err := db.GetNextKeyForReplication()
+func testApplyLogEntry(t *testing.T, engine db.Engine) {
+	replica := createTempDb(t, engine, true)
+
+	entries := []db.LogEntry{
+		{Seq: 1, Op: db.OpSet, Key: "party", Value: []byte("Great")},
+		{Seq: 2, Op: db.OpSet, Key: "party", Value: []byte("Bad")},
+		// Already applied entries must be ignored.
+		{Seq: 1, Op: db.OpSet, Key: "party", Value: []byte("Great")},
+	}
+
+	for _, e := range entries {
+		if err := replica.ApplyLogEntry(e); err != nil {
+			t.Fatalf("ApplyLogEntry(%+v): %v", e, err)
+		}
+	}
+
+	if value := getKey(t, replica, "party"); value != "Bad" {
+		t.Errorf(`Unexpected value for key "party": got %q, want %q`, value, "Bad")
+	}
+
+	seq, err := replica.AppliedSeq()
 	if err != nil {
-		t.Fatalf(`Unexpected error for GetNextKeyForReplication(): %v`, err)
+		t.Fatalf("AppliedSeq(): %v", err)
+	}
+
+	if seq != 2 {
+		t.Errorf("AppliedSeq(): got %d, want %d", seq, 2)
 	}
 
-	if !bytes.Equal(k, []byte("party")) || !bytes.Equal(v, []byte("Great")) {
-		t.Errorf(`GetNextKeyForReplication(): got %q, %q; want %q, %q`, k, v, "party", "Great")
+	// The batch is applied in a single transaction, so a failed entry
+	// rolls back the previous ones.
+	err = replica.ApplyLogEntries([]db.LogEntry{
+		{Seq: 3, Op: db.OpSet, Key: "party", Value: []byte("Great")},
+		{Seq: 4, Op: "bogus", Key: "party"},
+	})
+	if err == nil {
+		t.Fatalf("ApplyLogEntries() with an unknown operation: got nil error, want non-nil error")
 	}
 
-	if err := db.DeleteReplicationKey([]byte("party"), []byte("Bad")); err == nil {
-		t.Fatalf(`DeleteReplicationKey("party", "Bad"): got nil error, want non-nil error`)
+	if value := getKey(t, replica, "party"); value != "Bad" {
+		t.Errorf(`Value for key "party" after the failed batch: got %q, want %q`, value, "Bad")
 	}
+	if seq, err := replica.AppliedSeq(); err != nil || seq != 2 {
+		t.Errorf("AppliedSeq() after the failed batch: got %d, %v; want %d, nil", seq, err, 2)
+	}
+}
+
+func TestDeleteKey(t *testing.T) { forEachEngine(t, testDeleteKey) }
+
+func testDeleteKey(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "replica")
+
+	setKey(t, d, "party", "Great")
+
+	if err := d.DeleteKey("party"); err != nil {
+		t.Fatalf(`DeleteKey("party"): %v`, err)
+	}
+
+	if value, err := d.GetKey("party"); err != nil || value != nil {
+		t.Errorf(`GetKey("party") after deletion: got %q, %v; want nil, nil`, value, err)
+	}
+
+	e := nextEntry(t, d, 1)
+	if e == nil || e.Op != db.OpDelete || e.Key != "party" {
+		t.Fatalf("GetNextKeyForReplication(1): got %+v, want deletion of %q", e, "party")
+	}
+
+	replica := createTempDb(t, engine, true)
 
-	if err := db.DeleteReplicationKey([]byte("party"), []byte("Great")); err != nil {
-		t.Fatalf(`DeleteReplicationKey("party", "Great"): got %q, want nil error`, err)
+	if err := replica.DeleteKey("party"); err == nil {
+		t.Errorf(`DeleteKey("party") on replica: got nil error, want non-nil error`)
 	}
 
-	k, v, err = db.GetNextKeyForReplication()
+	entries, err := d.GetNextKeysForReplication(0, 10, 0)
 	if err != nil {
-		t.Fatalf(`Unexpected error for GetNextKeyForReplication(): %v`, err)
+		t.Fatalf("GetNextKeysForReplication(0, 10, 0): %v", err)
 	}
 
-	if k != nil || v != nil {
-		t.Errorf(`GetNextKeyForReplication(): got %v, %v; want nil, nil`, k, v)
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	if value, err := replica.GetKey("party"); err != nil || value != nil {
+		t.Errorf(`GetKey("party") on replica: got %q, %v; want nil, nil`, value, err)
 	}
 }
 
-func TestSetReadOnly(t *testing.T) {
-	db := createTempDb(t, true)
+func TestSetReadOnly(t *testing.T) { forEachEngine(t, testSetReadOnly) }
+
+func testSetReadOnly(t *testing.T, engine db.Engine) {
+	db := createTempDb(t, engine, true)
 
 	if err := db.SetKey("party", []byte("Bad")); err == nil {
 		t.Fatalf("SetKey(%q, %q): got nil error, want non-nil error", "party", []byte("Bad"))
 	}
 }
 
-func setKey(t *testing.T, d *db.Database, key, value string) {
+func setKey(t *testing.T, d db.Store, key, value string) {
 	t.Helper()
 
 	if err := d.SetKey(key, []byte(value)); err != nil {
@@ -103,7 +368,7 @@ func setKey(t *testing.T, d *db.Database, key, value string) {
 	}
 }
 
-func getKey(t *testing.T, d *db.Database, key string) string {
+func getKey(t *testing.T, d db.Store, key string) string {
 	t.Helper()
 
 	value, err := d.GetKey(key)
@@ -114,8 +379,11 @@ func getKey(t *testing.T, d *db.Database, key string) string {
 	return string(value)
 }
 
-func TestDeleteExtraKeys(t *testing.T) {
-	db := createTempDb(t, false)
+func TestDeleteExtraKeys(t *testing.T) { forEachEngine(t, testDeleteExtraKeys) }
+
+func testDeleteExtraKeys(t *testing.T, engine db.Engine) {
+	db := createTempDb(t, engine, false)
+	setReplicas(t, db, "replica")
 
 	setKey(t, db, "party", "Great")
 	setKey(t, db, "us", "CapitalistPigs")
@@ -131,4 +399,585 @@ func TestDeleteExtraKeys(t *testing.T) {
 	if value := getKey(t, db, "us"); value != "" {
 		t.Errorf(`Unexpected value for key "us": got %q, want %q`, value, "")
 	}
+
+	e := nextEntry(t, db, 2)
+	if e == nil || e.Op != "delete" || e.Key != "us" {
+		t.Errorf("GetNextKeyForReplication(2): got %+v, want deletion of %q", e, "us")
+	}
+}
+
+func TestSetGetKeys(t *testing.T) { forEachEngine(t, testSetGetKeys) }
+
+func testSetGetKeys(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+
+	kvs := []db.KeyValue{
+		{Key: "party", Value: []byte("Great")},
+		{Key: "us", Value: []byte("CapitalistPigs")},
+	}
+	if err := d.SetKeys(kvs); err != nil {
+		t.Fatalf("SetKeys(%+v): %v", kvs, err)
+	}
+
+	kvs, err := d.GetKeys([]string{"us", "missing", "party"})
+	if err != nil {
+		t.Fatalf("GetKeys(): %v", err)
+	}
+
+	var values [][]byte
+	for _, kv := range kvs {
+		values = append(values, kv.Value)
+	}
+
+	want := [][]byte{[]byte("CapitalistPigs"), nil, []byte("Great")}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("GetKeys(): got %q, want %q", values, want)
+	}
+
+	if kvs[0].Meta.Version != 2 || kvs[2].Meta.Version != 1 {
+		t.Errorf("GetKeys(): got versions %d and %d, want %d and %d", kvs[0].Meta.Version, kvs[2].Meta.Version, 2, 1)
+	}
+
+	if seq, err := d.LastSeq(); err != nil || seq != 2 {
+		t.Errorf("LastSeq() after SetKeys: got %d, %v; want %d, nil", seq, err, 2)
+	}
+
+	replica := createTempDb(t, engine, true)
+	if err := replica.SetKeys(kvs); err == nil {
+		t.Errorf("SetKeys() on replica: got nil error, want non-nil error")
+	}
+}
+
+func TestScan(t *testing.T) { forEachEngine(t, testScan) }
+
+func testScan(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+
+	for _, k := range []string{"user:3", "user:1", "admin", "user:2", "zebra"} {
+		setKey(t, d, k, "value-"+k)
+	}
+
+	keysOf := func(kvs []db.KeyValue) []string {
+		var res []string
+		for _, kv := range kvs {
+			res = append(res, kv.Key)
+		}
+		return res
+	}
+
+	cases := []struct {
+		prefix, start, end string
+		limit              int
+		want               []string
+		wantNext           string
+	}{
+		{"", "", "", 0, []string{"admin", "user:1", "user:2", "user:3", "zebra"}, ""},
+		{"user:", "", "", 2, []string{"user:1", "user:2"}, "user:3"},
+		{"user:", "user:3", "", 2, []string{"user:3"}, ""},
+		{"", "b", "user:3", 0, []string{"user:1", "user:2"}, ""},
+		{"x", "", "", 10, nil, ""},
+	}
+
+	for _, c := range cases {
+		kvs, next, err := d.Scan(c.prefix, c.start, c.end, c.limit)
+		if err != nil {
+			t.Fatalf("Scan(%q, %q, %q, %d): %v", c.prefix, c.start, c.end, c.limit, err)
+		}
+
+		if got := keysOf(kvs); !reflect.DeepEqual(got, c.want) || next != c.wantNext {
+			t.Errorf("Scan(%q, %q, %q, %d): got %q, next %q; want %q, next %q", c.prefix, c.start, c.end, c.limit, got, next, c.want, c.wantNext)
+		}
+	}
+
+	kvs, _, err := d.Scan("zebra", "", "", 1)
+	if err != nil || len(kvs) != 1 || string(kvs[0].Value) != "value-zebra" {
+		t.Errorf(`Scan("zebra", "", "", 1): got %+v, %v; want the value of "zebra"`, kvs, err)
+	}
+}
+
+func TestScanManyKeys(t *testing.T) { forEachEngine(t, testScanManyKeys) }
+
+func testScanManyKeys(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+
+	const n = 1000
+	var kvs []db.KeyValue
+	for _, i := range rand.Perm(n) {
+		kvs = append(kvs, db.KeyValue{Key: fmt.Sprintf("key:%04d", i), Value: []byte("value")})
+	}
+	if err := d.SetKeys(kvs); err != nil {
+		t.Fatalf("SetKeys() of %d keys: %v", n, err)
+	}
+
+	// Every key ending with a digit divisible by 3 is deleted.
+	if err := d.DeleteExtraKeys(func(key string) bool { return key[len(key)-1]%3 == 0 }); err != nil {
+		t.Fatalf("DeleteExtraKeys(): %v", err)
+	}
+
+	var want []string
+	for i := 0; i < n; i++ {
+		if key := fmt.Sprintf("key:%04d", i); key[len(key)-1]%3 != 0 {
+			want = append(want, key)
+		}
+	}
+
+	res, _, err := d.Scan("key:", "", "", 0)
+	if err != nil {
+		t.Fatalf("Scan(): %v", err)
+	}
+
+	var got []string
+	for _, kv := range res {
+		got = append(got, kv.Key)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan() after the deletions: got %q, want %q", got, want)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) { forEachEngine(t, testConditionalWrites) }
+
+func testConditionalWrites(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+
+	steps := []struct {
+		name    string
+		write   func() error
+		wantErr bool
+		want    string
+	}{
+		{"set if absent", func() error { return d.SetKeyIf("party", []byte("Great"), db.Condition{IfAbsent: true}) }, false, "Great"},
+		{"set if absent for existing key", func() error { return d.SetKeyIf("party", []byte("Bad"), db.Condition{IfAbsent: true}) }, true, "Great"},
+		{"set if value differs", func() error { return d.SetKeyIf("party", []byte("Bad"), db.Condition{IfValue: []byte("Good")}) }, true, "Great"},
+		{"set if value matches", func() error { return d.SetKeyIf("party", []byte("Bad"), db.Condition{IfValue: []byte("Great")}) }, false, "Bad"},
+		{"delete if ETag differs", func() error { return d.DeleteKeyIf("party", db.Condition{IfETag: "1"}) }, true, "Bad"},
+		{"delete if ETag matches", func() error { return d.DeleteKeyIf("party", db.Condition{IfETag: "2"}) }, false, ""},
+		{"set if exists for missing key", func() error { return d.SetKeyIf("party", []byte("Great"), db.Condition{IfExists: true}) }, true, ""},
+	}
+
+	for _, st := range steps {
+		err := st.write()
+		if st.wantErr && !errors.Is(err, db.ErrConditionFailed) {
+			t.Errorf("%s: got error %v, want %v", st.name, err, db.ErrConditionFailed)
+		} else if !st.wantErr && err != nil {
+			t.Errorf("%s: got error %v, want nil", st.name, err)
+		}
+
+		if value := getKey(t, d, "party"); value != st.want {
+			t.Errorf("%s: got value %q, want %q", st.name, value, st.want)
+		}
+	}
+
+	// Only the successful writes are replicated.
+	if seq, err := d.LastSeq(); err != nil || seq != 3 {
+		t.Errorf("LastSeq(): got %d, %v; want %d, nil", seq, err, 3)
+	}
+}
+
+func TestKeyMeta(t *testing.T) { forEachEngine(t, testKeyMeta) }
+
+func testKeyMeta(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "replica")
+
+	setKey(t, d, "us", "CapitalistPigs")
+
+	meta, err := d.SetKeyWith("party", []byte(`{"great": true}`), db.SetOptions{ContentType: "application/json"})
+	if err != nil {
+		t.Fatalf("SetKeyWith(): %v", err)
+	}
+
+	if meta.Version != 2 || meta.ContentType != "application/json" || meta.Modified.IsZero() {
+		t.Errorf("SetKeyWith(): got metadata %+v, want version 2 with the content type and modification time", meta)
+	}
+
+	_, got, err := d.GetKeyMeta("party")
+	if err != nil || got != meta {
+		t.Errorf("GetKeyMeta(%q): got %+v, %v; want %+v, nil", "party", got, err, meta)
+	}
+
+	// Replicas report the same versions as the leader.
+	replica := createTempDb(t, engine, true)
+
+	entries, err := d.GetNextKeysForReplication(0, 10, 0)
+	if err != nil {
+		t.Fatalf("GetNextKeysForReplication(0, 10, 0): %v", err)
+	}
+
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	if _, got, err := replica.GetKeyMeta("party"); err != nil || got != meta {
+		t.Errorf("GetKeyMeta(%q) on replica: got %+v, %v; want %+v, nil", "party", got, err, meta)
+	}
+
+	// The moved keys get a version greater than the one on the previous owner.
+	owner := createTempDb(t, engine, false)
+
+	if err := owner.SetKeysIfAbsent([]db.KeyValue{{Key: "party", Value: []byte("Great"), Meta: meta}}); err != nil {
+		t.Fatalf("SetKeysIfAbsent(): %v", err)
+	}
+
+	if _, got, err := owner.GetKeyMeta("party"); err != nil || got.Version <= meta.Version || !got.Modified.Equal(meta.Modified) {
+		t.Errorf("GetKeyMeta(%q) on the new owner: got %+v, %v; want version greater than %d", "party", got, err, meta.Version)
+	}
+}
+
+func TestMoveKeysWithReplica(t *testing.T) { forEachEngine(t, testMoveKeysWithReplica) }
+
+func testMoveKeysWithReplica(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "replica")
+	setKey(t, d, "us", "CapitalistPigs")
+
+	// The version from the previous owner moves the log sequence forward.
+	moved := db.KeyValue{Key: "party", Value: []byte("Great"), Meta: db.Meta{Version: 100}}
+	if err := d.SetKeysIfAbsent([]db.KeyValue{moved}); err != nil {
+		t.Fatalf("SetKeysIfAbsent(): %v", err)
+	}
+	setKey(t, d, "ussr", "Moscow")
+
+	entries, err := d.GetNextKeysForReplication(1, 10, 0)
+	if err != nil {
+		t.Fatalf("GetNextKeysForReplication(1, 10, 0) after moving the keys: %v", err)
+	}
+
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if want := []string{"party", "ussr"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("GetNextKeysForReplication(1, 10, 0): got keys %q, want %q", keys, want)
+	}
+
+	replica := createTempDb(t, engine, true)
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	if got := getKey(t, replica, "party"); got != "Great" {
+		t.Errorf("GetKey(%q) on the replica: got %q, want %q", "party", got, "Great")
+	}
+}
+
+func TestExpiration(t *testing.T) { forEachEngine(t, testExpiration) }
+
+func testExpiration(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "replica")
+
+	setKey(t, d, "us", "CapitalistPigs")
+
+	meta, err := d.SetKeyWith("party", []byte("Great"), db.SetOptions{TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("SetKeyWith(): %v", err)
+	}
+	if want := meta.Modified.Add(50 * time.Millisecond); !meta.Expires.Equal(want) {
+		t.Errorf("SetKeyWith(): got expiration time %v, want %v", meta.Expires, want)
+	}
+
+	if got := getKey(t, d, "party"); got != "Great" {
+		t.Errorf("GetKey(%q) before expiration: got %q, want %q", "party", got, "Great")
+	}
+
+	if n, err := d.DeleteExpiredKeys(10); err != nil || n != 0 {
+		t.Errorf("DeleteExpiredKeys(10) before expiration: got %d, %v; want 0, nil", n, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The expired keys are hidden before the sweeper deletes them.
+	if got := getKey(t, d, "party"); got != "" {
+		t.Errorf("GetKey(%q) after expiration: got %q, want an empty value", "party", got)
+	}
+
+	kvs, _, err := d.Scan("", "", "", 0)
+	if err != nil || len(kvs) != 1 || kvs[0].Key != "us" {
+		t.Errorf("Scan() after expiration: got %+v, %v; want only %q", kvs, err, "us")
+	}
+
+	if err := d.SetKeyIf("party", []byte("Bad"), db.Condition{IfAbsent: true}); err != nil {
+		t.Errorf("SetKeyIf(IfAbsent) for an expired key: %v", err)
+	}
+	if _, err := d.SetKeyWith("party", []byte("Great"), db.SetOptions{TTL: time.Millisecond}); err != nil {
+		t.Fatalf("SetKeyWith(): %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if n, err := d.DeleteExpiredKeys(10); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredKeys(10) after expiration: got %d, %v; want 1, nil", n, err)
+	}
+	if n, err := d.DeleteExpiredKeys(10); err != nil || n != 0 {
+		t.Errorf("DeleteExpiredKeys(10) after the sweep: got %d, %v; want 0, nil", n, err)
+	}
+
+	// The replicas receive the deletion through the replication log.
+	entries, err := d.GetNextKeysForReplication(0, 10, 0)
+	if err != nil {
+		t.Fatalf("GetNextKeysForReplication(0, 10, 0): %v", err)
+	}
+	if last := entries[len(entries)-1]; last.Op != db.OpDelete || last.Key != "party" {
+		t.Errorf("The last log entry: got %+v, want the deletion of %q", last, "party")
+	}
+
+	replica := createTempDb(t, engine, true)
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	if got := getKey(t, replica, "party"); got != "" {
+		t.Errorf("GetKey(%q) on replica: got %q, want an empty value", "party", got)
+	}
+	if _, err := replica.DeleteExpiredKeys(10); err != db.ErrReadOnly {
+		t.Errorf("DeleteExpiredKeys(10) on replica: got %v, want %v", err, db.ErrReadOnly)
+	}
+}
+
+func TestIncrement(t *testing.T) { forEachEngine(t, testIncrement) }
+
+func testIncrement(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "replica")
+
+	for _, delta := range []int64{5, -2} {
+		if _, _, err := d.Increment("counter", delta); err != nil {
+			t.Fatalf("Increment(%q, %d): %v", "counter", delta, err)
+		}
+	}
+
+	n, meta, err := d.Increment("counter", 10)
+	if err != nil || n != 13 || meta.Version != 3 {
+		t.Errorf("Increment(%q, 10): got %d, %+v, %v; want 13 with version 3", "counter", n, meta, err)
+	}
+
+	if got := getKey(t, d, "counter"); got != "13" {
+		t.Errorf("GetKey(%q): got %q, want %q", "counter", got, "13")
+	}
+
+	setKey(t, d, "party", "Great")
+	if _, _, err := d.Increment("party", 1); !errors.Is(err, db.ErrNotInteger) {
+		t.Errorf("Increment(%q, 1) for a string: got %v, want %v", "party", err, db.ErrNotInteger)
+	}
+
+	setKey(t, d, "max", "9223372036854775807")
+	if _, _, err := d.Increment("max", 1); !errors.Is(err, db.ErrOverflow) {
+		t.Errorf("Increment(%q, 1) for the max value: got %v, want %v", "max", err, db.ErrOverflow)
+	}
+
+	// The replicas receive the resulting value.
+	entries, err := d.GetNextKeysForReplication(0, 10, 0)
+	if err != nil {
+		t.Fatalf("GetNextKeysForReplication(0, 10, 0): %v", err)
+	}
+
+	replica := createTempDb(t, engine, true)
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	if got := getKey(t, replica, "counter"); got != "13" {
+		t.Errorf("GetKey(%q) on replica: got %q, want %q", "counter", got, "13")
+	}
+	if _, _, err := replica.Increment("counter", 1); err != db.ErrReadOnly {
+		t.Errorf("Increment(%q, 1) on replica: got %v, want %v", "counter", err, db.ErrReadOnly)
+	}
+}
+
+func TestNamespaces(t *testing.T) { forEachEngine(t, testNamespaces) }
+
+func testNamespaces(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setReplicas(t, d, "replica")
+
+	if err := d.CreateNamespace("team"); err != nil {
+		t.Fatalf("CreateNamespace(%q): %v", "team", err)
+	}
+	if err := d.CreateNamespace("team"); err != nil {
+		t.Errorf("CreateNamespace(%q) for an existing namespace: %v", "team", err)
+	}
+	if err := d.CreateNamespace("bad/name"); !errors.Is(err, db.ErrInvalidNamespace) {
+		t.Errorf("CreateNamespace(%q): got %v, want %v", "bad/name", err, db.ErrInvalidNamespace)
+	}
+
+	team := d.In("team")
+	setKey(t, d, "party", "Great")
+	setKey(t, team, "party", "Team")
+
+	if got := getKey(t, d, "party"); got != "Great" {
+		t.Errorf("GetKey(%q) in the default namespace: got %q, want %q", "party", got, "Great")
+	}
+	if got := getKey(t, team, "party"); got != "Team" {
+		t.Errorf("GetKey(%q) in namespace %q: got %q, want %q", "party", "team", got, "Team")
+	}
+
+	if _, err := d.In("missing").GetKey("party"); !errors.Is(err, db.ErrNoNamespace) {
+		t.Errorf("GetKey(%q) in a missing namespace: got %v, want %v", "party", err, db.ErrNoNamespace)
+	}
+	if err := d.In("missing").SetKey("party", []byte("Bad")); !errors.Is(err, db.ErrNoNamespace) {
+		t.Errorf("SetKey(%q) in a missing namespace: got %v, want %v", "party", err, db.ErrNoNamespace)
+	}
+
+	if names, err := d.Namespaces(); err != nil || !reflect.DeepEqual(names, []string{"team"}) {
+		t.Errorf("Namespaces(): got %q, %v; want %q", names, err, []string{"team"})
+	}
+
+	// The namespaces are replicated together with their keys.
+	replica := createTempDb(t, engine, true)
+
+	entries, err := d.GetNextKeysForReplication(0, 10, 0)
+	if err != nil {
+		t.Fatalf("GetNextKeysForReplication(0, 10, 0): %v", err)
+	}
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	if got := getKey(t, replica.In("team"), "party"); got != "Team" {
+		t.Errorf("GetKey(%q) in namespace %q on replica: got %q, want %q", "party", "team", got, "Team")
+	}
+
+	if err := d.DeleteNamespace("team"); err != nil {
+		t.Fatalf("DeleteNamespace(%q): %v", "team", err)
+	}
+	if _, err := team.GetKey("party"); !errors.Is(err, db.ErrNoNamespace) {
+		t.Errorf("GetKey(%q) in a deleted namespace: got %v, want %v", "party", err, db.ErrNoNamespace)
+	}
+	if got := getKey(t, d, "party"); got != "Great" {
+		t.Errorf("GetKey(%q) in the default namespace after the deletion: got %q, want %q", "party", got, "Great")
+	}
+
+	seq := entries[len(entries)-1].Seq
+	if entries, err = d.GetNextKeysForReplication(seq, 10, 0); err != nil {
+		t.Fatalf("GetNextKeysForReplication(%d, 10, 0): %v", seq, err)
+	}
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	if names, err := replica.Namespaces(); err != nil || len(names) != 0 {
+		t.Errorf("Namespaces() on replica after the deletion: got %q, %v; want none", names, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) { forEachEngine(t, testSnapshot) }
+
+func testSnapshot(t *testing.T, engine db.Engine) {
+	d := createTempDb(t, engine, false)
+	setKey(t, d, "party", "Great")
+	if err := d.CreateNamespace("team"); err != nil {
+		t.Fatalf("CreateNamespace(%q): %v", "team", err)
+	}
+	setKey(t, d.In("team"), "party", "Team")
+
+	seq, entries, err := d.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot(): %v", err)
+	}
+	if lastSeq, _ := d.LastSeq(); seq != lastSeq {
+		t.Errorf("Snapshot(): got seq %d, want %d", seq, lastSeq)
+	}
+
+	// The snapshot replaces the keys and the namespaces the replica had.
+	replica := createTempDb(t, engine, true)
+	stale := []db.LogEntry{
+		{Seq: 1, Op: db.OpSet, Key: "us", Value: []byte("CapitalistPigs")},
+		{Seq: 2, Op: db.OpCreateNamespace, Namespace: "old"},
+		{Seq: 3, Op: db.OpSet, Namespace: "old", Key: "party", Value: []byte("Old")},
+	}
+	if err := replica.ApplyLogEntries(stale); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	if err := replica.LoadSnapshot(seq, entries); err != nil {
+		t.Fatalf("LoadSnapshot(): %v", err)
+	}
+
+	if got := getKey(t, replica, "party"); got != "Great" {
+		t.Errorf("GetKey(%q) on the replica: got %q, want %q", "party", got, "Great")
+	}
+	if got := getKey(t, replica.In("team"), "party"); got != "Team" {
+		t.Errorf("GetKey(%q) in namespace %q on the replica: got %q, want %q", "party", "team", got, "Team")
+	}
+	if got := getKey(t, replica, "us"); got != "" {
+		t.Errorf("GetKey(%q) on the replica after the snapshot: got %q, want none", "us", got)
+	}
+	if names, err := replica.Namespaces(); err != nil || !reflect.DeepEqual(names, []string{"team"}) {
+		t.Errorf("Namespaces() on the replica: got %q, %v; want %q", names, err, []string{"team"})
+	}
+
+	want, err := d.GetKeys([]string{"party"})
+	if err != nil {
+		t.Fatalf("GetKeys(): %v", err)
+	}
+	got, err := replica.GetKeys([]string{"party"})
+	if err != nil {
+		t.Fatalf("GetKeys() on the replica: %v", err)
+	}
+	if got[0].Meta.Version != want[0].Meta.Version {
+		t.Errorf("GetKeys() on the replica: got version %d, want %d", got[0].Meta.Version, want[0].Meta.Version)
+	}
+
+	if applied, err := replica.AppliedSeq(); err != nil || applied != seq {
+		t.Errorf("AppliedSeq() after the snapshot: got %d, %v; want %d, nil", applied, err, seq)
+	}
+}
+
+func TestLogEngineRecovery(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "kvdb.log")
+
+	open := func() (*db.Database, func() error) {
+		t.Helper()
+
+		d, closeFunc, err := db.Open(db.EngineLog, name, false)
+		if err != nil {
+			t.Fatalf("Could not open the log database: %v", err)
+		}
+		return d, closeFunc
+	}
+
+	d, closeFunc := open()
+	setReplicas(t, d, "replica")
+	setKey(t, d, "party", "Great")
+	setKey(t, d, "us", "CapitalistPigs")
+	if err := d.DeleteKey("us"); err != nil {
+		t.Fatalf(`DeleteKey("us"): %v`, err)
+	}
+	if err := d.CreateNamespace("ussr"); err != nil {
+		t.Fatalf(`CreateNamespace("ussr"): %v`, err)
+	}
+	setKey(t, d.In("ussr"), "party", "Communist")
+	closeFunc()
+
+	// A record that was not written completely before the crash.
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Could not open the log file: %v", err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42, 42, 42})
+	f.Close()
+
+	d, closeFunc = open()
+	if value := getKey(t, d, "party"); value != "Great" {
+		t.Errorf(`Value for key "party" after reopening: got %q, want %q`, value, "Great")
+	}
+	if value := getKey(t, d, "us"); value != "" {
+		t.Errorf(`Value for deleted key "us" after reopening: got %q, want an empty value`, value)
+	}
+	if value := getKey(t, d.In("ussr"), "party"); value != "Communist" {
+		t.Errorf(`Value for key "party" in namespace "ussr" after reopening: got %q, want %q`, value, "Communist")
+	}
+
+	// The new writes go after the truncated record.
+	setKey(t, d, "a", "First")
+	closeFunc()
+
+	d, closeFunc = open()
+	defer closeFunc()
+
+	if value := getKey(t, d, "a"); value != "First" {
+		t.Errorf(`Value for key "a" after reopening: got %q, want %q`, value, "First")
+	}
+	if e := nextEntry(t, d, 5); e == nil || e.Seq != 6 || e.Key != "a" {
+		t.Errorf("GetNextKeyForReplication(5) after reopening: got %+v, want entry 6 for %q", e, "a")
+	}
 }
@@ -0,0 +1,106 @@
+package db
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// engine is the transactional storage of named buckets with ordered keys
+// that the Database is built on. Its API is the subset of bbolt used by
+// the Database, so the bbolt engine is a thin wrapper around it.
+// Update runs fn in a read-write transaction that is rolled back if fn
+// fails, and View runs fn in a read-only transaction.
+type engine interface {
+	Update(fn func(txn) error) error
+	View(fn func(txn) error) error
+	Close() error
+}
+
+// txn is a transaction of the engine.
+type txn interface {
+	// Bucket returns the bucket or nil if it does not exist.
+	Bucket(name []byte) bucket
+	CreateBucketIfNotExists(name []byte) (bucket, error)
+	// DeleteBucket deletes the bucket if it exists.
+	DeleteBucket(name []byte) error
+}
+
+// bucket is a collection of keys in the byte order.
+// The slices returned by the bucket are only valid in the transaction.
+type bucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Cursor() cursor
+	ForEach(fn func(k, v []byte) error) error
+	NextSequence() (uint64, error)
+	Sequence() uint64
+	SetSequence(v uint64) error
+}
+
+// cursor iterates over the keys of the bucket in the byte order.
+// The methods return nil keys when there are no more keys.
+type cursor interface {
+	First() (key, value []byte)
+	Next() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+}
+
+// boltEngine is the engine that stores the buckets in a bbolt database file.
+type boltEngine struct {
+	db *bolt.DB
+}
+
+func openBolt(path string) (*boltEngine, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &boltEngine{db: db}, nil
+}
+
+func (e *boltEngine) Update(fn func(txn) error) error {
+	return e.db.Update(func(tx *bolt.Tx) error { return fn(boltTxn{tx}) })
+}
+
+func (e *boltEngine) View(fn func(txn) error) error {
+	return e.db.View(func(tx *bolt.Tx) error { return fn(boltTxn{tx}) })
+}
+
+func (e *boltEngine) Close() error {
+	return e.db.Close()
+}
+
+type boltTxn struct {
+	tx *bolt.Tx
+}
+
+func (t boltTxn) Bucket(name []byte) bucket {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (t boltTxn) CreateBucketIfNotExists(name []byte) (bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t boltTxn) DeleteBucket(name []byte) error {
+	if err := t.tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+func (b boltBucket) Cursor() cursor {
+	return b.Bucket.Cursor()
+}
@@ -0,0 +1,1027 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// logHeaderSize is the size of the record header: the payload length and its CRC-32.
+	logHeaderSize = 8
+	// logCompactSuffix is appended to the segment path for the file written by compaction.
+	logCompactSuffix = ".compact"
+	// logSegmentSize is the size at which the active segment is sealed.
+	logSegmentSize = 16 << 20
+	// logCompactMinSize is the log size below which the log is not compacted.
+	logCompactMinSize = 64 << 20
+	// logCompactInterval is how often the log size is checked for compaction.
+	logCompactInterval = time.Minute
+	// logCompactRecordSize is the approximate size of the records written by compaction.
+	logCompactRecordSize = 1 << 20
+)
+
+// The operations in the log records.
+const (
+	logOpCreateBucket byte = iota + 1
+	logOpDeleteBucket
+	logOpPut
+	logOpDelete
+	logOpSetSequence
+	// logOpReset deletes all buckets. The segment written by compaction
+	// starts with it, so it replaces the segments before it.
+	logOpReset
+)
+
+var errCorruptLog = errors.New("corrupt log record")
+
+// logStore is the engine that appends the changes to a log and keeps
+// only the keys and the positions of their values in memory, like Bitcask.
+// Every Update is written as a single checksummed record, so the writes are
+// sequential. The log is split into segments: the records are appended to the
+// active segment at the path, which is sealed by renaming it to the path with
+// the segment number once it reaches the segment size. The index is rebuilt
+// from the segments when the log is opened, and the records of the active
+// segment that were not written completely before a crash are truncated.
+// The sealed segments are compacted in the background by rewriting their
+// live keys to a new segment once the log has doubled in size since the last
+// compaction.
+type logStore struct {
+	// writeMu serializes the writers. They read the index without mu,
+	// because nobody else changes it, and only take mu to publish
+	// the changes once they are written to the log.
+	writeMu sync.Mutex
+	// sealed are the sequences of the buckets at the end of the last
+	// sealed segment. Compaction writes them to the new segment.
+	sealed map[string]uint64
+	// segmentSize is the size at which the active segment is sealed.
+	segmentSize int64
+
+	// mu guards the fields below from the readers.
+	// They are only changed with both writeMu and mu held.
+	mu    sync.RWMutex
+	path  string
+	index map[string]*memBucket
+	// segs are the files of the segments by their numbers,
+	// and sizes are the sizes of the sealed ones.
+	segs  map[uint32]*os.File
+	sizes map[uint32]int64
+	// active is the number of the active segment and size is its size.
+	active uint32
+	size   int64
+	// compacted is the log size after the last compaction or open.
+	compacted int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func openLog(path string) (*logStore, error) {
+	e := &logStore{
+		segmentSize: logSegmentSize,
+		path:        path,
+		index:       make(map[string]*memBucket),
+		segs:        make(map[uint32]*os.File),
+		sizes:       make(map[uint32]int64),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if err := e.load(); err != nil {
+		e.closeFiles()
+		return nil, fmt.Errorf("loading the log %q: %w", path, err)
+	}
+	e.compacted = e.logSize()
+
+	go e.compactLoop()
+	return e, nil
+}
+
+func (e *logStore) segmentPath(id uint32) string {
+	return e.path + "." + strconv.FormatUint(uint64(id), 10)
+}
+
+// sealedSegments returns the numbers of the sealed segments in the ascending order.
+// The files of the compaction that did not finish are removed, so that it is started over.
+func (e *logStore) sealedSegments() ([]uint32, error) {
+	dir := filepath.Dir(e.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(e.path) + "."
+
+	var ids []uint32
+	for _, ent := range entries {
+		name := ent.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		} else if strings.HasSuffix(name, logCompactSuffix) {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 32)
+		if err != nil || id == 0 {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// load rebuilds the index from the sealed segments and the active one.
+// The segments before the last one written by compaction are removed.
+func (e *logStore) load() error {
+	ids, err := e.sealedSegments()
+	if err != nil {
+		return err
+	}
+
+	var base uint32
+	for _, id := range ids {
+		f, err := os.Open(e.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		e.segs[id] = f
+
+		size, reset, err := e.loadSegment(f, id, false)
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", id, err)
+		}
+		if reset {
+			base = id
+		}
+		e.sizes[id] = size
+	}
+
+	e.active = 1
+	if len(ids) > 0 {
+		e.active = ids[len(ids)-1] + 1
+	}
+	e.sealed = e.bucketSequences()
+
+	for _, id := range ids {
+		if id < base {
+			e.segs[id].Close()
+			delete(e.segs, id)
+			delete(e.sizes, id)
+			os.Remove(e.segmentPath(id))
+		}
+	}
+
+	f, err := os.OpenFile(e.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	e.segs[e.active] = f
+
+	e.size, _, err = e.loadSegment(f, e.active, true)
+	return err
+}
+
+// loadSegment replays the records of the segment and returns its size and
+// whether it starts with a reset. The damaged end of the active segment
+// is truncated, while the sealed segments must be complete.
+func (e *logStore) loadSegment(f *os.File, id uint32, active bool) (size int64, reset bool, err error) {
+	size, damaged, err := readLog(f, func(payload []byte, at int64) error {
+		if at == logHeaderSize && payload[0] == logOpReset {
+			reset = true
+		}
+		if err := replayLog(e.index, payload, id, at); err != nil {
+			return fmt.Errorf("record at %d: %w", at-logHeaderSize, err)
+		}
+		return nil
+	})
+	if err != nil || !damaged {
+		return size, reset, err
+	} else if !active {
+		return 0, false, fmt.Errorf("%w: the segment is damaged at %d", errCorruptLog, size)
+	}
+
+	log.Printf("Truncating the damaged end of the log %q at %d bytes", f.Name(), size)
+	if err := f.Truncate(size); err != nil {
+		return 0, false, err
+	}
+	return size, reset, f.Sync()
+}
+
+// readLog calls fn for the payload of every record of the segment together
+// with the offset of the payload. It stops at the first record that is
+// incomplete or does not match its checksum, and reports the end as damaged.
+func readLog(f *os.File, fn func(payload []byte, at int64) error) (size int64, damaged bool, err error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, 0, st.Size()))
+	header := make([]byte, logHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return size, false, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return size, true, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+
+		n := int64(binary.BigEndian.Uint32(header))
+		if n == 0 || size+logHeaderSize+n > st.Size() {
+			return size, true, nil
+		}
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, false, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return size, true, nil
+		}
+
+		if err := fn(payload, size+logHeaderSize); err != nil {
+			return 0, false, err
+		}
+		size += logHeaderSize + n
+	}
+}
+
+func (e *logStore) txn(writable bool) *logStoreTxn {
+	return &logStoreTxn{
+		e:        e,
+		writable: writable,
+		start:    e.size,
+		rec:      newLogRecord(),
+	}
+}
+
+func (e *logStore) Update(fn func(txn) error) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	t := e.txn(true)
+	if err := fn(t); err != nil {
+		return err
+	}
+	if t.rec.empty() {
+		return nil
+	}
+
+	// The readers are not blocked while the record is written and synced,
+	// and only see the changes once they are durable.
+	f := e.segs[e.active]
+	n, err := writeLogRecord(f, e.size, t.rec)
+	if err != nil {
+		f.Truncate(e.size)
+		return err
+	}
+
+	e.mu.Lock()
+	err = replayLog(e.index, t.rec.buf[logHeaderSize:], e.active, e.size+logHeaderSize)
+	e.size += n
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if e.size >= e.segmentSize {
+		if err := e.seal(); err != nil {
+			log.Printf("Error sealing the segment %d of the log %q: %v", e.active, e.path, err)
+		}
+	}
+	return nil
+}
+
+func (e *logStore) View(fn func(txn) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return fn(e.txn(false))
+}
+
+func (e *logStore) Close() error {
+	close(e.stop)
+	<-e.done
+
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.closeFiles()
+}
+
+func (e *logStore) closeFiles() error {
+	var err error
+	for _, f := range e.segs {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// logSize returns the total size of the segments.
+func (e *logStore) logSize() int64 {
+	size := e.size
+	for _, s := range e.sizes {
+		size += s
+	}
+	return size
+}
+
+// bucketSequences returns the sequences of the buckets in the index.
+func (e *logStore) bucketSequences() map[string]uint64 {
+	seqs := make(map[string]uint64, len(e.index))
+	for name, b := range e.index {
+		seqs[name] = b.seq
+	}
+	return seqs
+}
+
+// seal renames the active segment to the path with its number
+// and starts a new one. It is called with writeMu held.
+func (e *logStore) seal() error {
+	id := e.active
+	if err := os.Rename(e.path, e.segmentPath(id)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(e.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		// The writes go on to the same segment.
+		os.Rename(e.segmentPath(id), e.path)
+		return err
+	}
+	if err := syncDir(filepath.Dir(e.path)); err != nil {
+		log.Printf("Error syncing the directory of the log %q: %v", e.path, err)
+	}
+
+	e.sealed = e.bucketSequences()
+
+	e.mu.Lock()
+	e.sizes[id] = e.size
+	e.active, e.size = id+1, 0
+	e.segs[e.active] = f
+	e.mu.Unlock()
+
+	return nil
+}
+
+func (e *logStore) compactLoop() {
+	defer close(e.done)
+
+	t := time.NewTicker(logCompactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-t.C:
+		}
+
+		if !e.needsCompaction() {
+			continue
+		}
+		if err := e.compact(); err != nil {
+			log.Printf("Error compacting the log %q: %v", e.path, err)
+		}
+	}
+}
+
+func (e *logStore) needsCompaction() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	size := e.logSize()
+	return size >= logCompactMinSize && size >= 2*e.compacted
+}
+
+// compact seals the active segment and rewrites the live keys of the sealed
+// segments to a new segment that replaces them. The segments are not changed
+// once sealed, so the writers and the readers are only blocked while
+// the segments are swapped.
+func (e *logStore) compact() error {
+	e.writeMu.Lock()
+	if e.size > 0 {
+		if err := e.seal(); err != nil {
+			e.writeMu.Unlock()
+			return err
+		}
+	}
+
+	var ids []uint32
+	for id := range e.sizes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	files := make([]*os.File, len(ids))
+	for i, id := range ids {
+		files[i] = e.segs[id]
+	}
+	sealed := e.sealed
+	e.writeMu.Unlock()
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// The new segment takes the number of the last sealed one.
+	last := ids[len(ids)-1]
+	f, moved, size, err := e.rewrite(ids, files, sealed, last)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), e.segmentPath(last)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := syncDir(filepath.Dir(e.path)); err != nil {
+		log.Printf("Error syncing the directory of the log %q: %v", e.path, err)
+	}
+
+	e.writeMu.Lock()
+	e.mu.Lock()
+	for _, m := range moved {
+		if b := e.index[m.name]; b != nil {
+			if loc, ok := b.get(m.key); ok && bytes.Equal(loc, m.from) {
+				b.put(m.key, m.to)
+			}
+		}
+	}
+	for _, id := range ids {
+		delete(e.segs, id)
+		delete(e.sizes, id)
+	}
+	e.segs[last], e.sizes[last] = f, size
+	e.compacted = e.logSize()
+	e.mu.Unlock()
+	e.writeMu.Unlock()
+
+	for i, id := range ids {
+		files[i].Close()
+		if id != last {
+			os.Remove(e.segmentPath(id))
+		}
+	}
+	return nil
+}
+
+// logMove is a live key that compaction moved to the new segment.
+type logMove struct {
+	name, key string
+	from, to  []byte
+}
+
+// rewrite writes the buckets with their sequences at the end of the sealed
+// segments and the keys from the segments that are still live to a new
+// segment file with the number last. It returns the file together with
+// the new positions of the keys.
+func (e *logStore) rewrite(ids []uint32, files []*os.File, sealed map[string]uint64, last uint32) (f *os.File, moved []logMove, size int64, err error) {
+	f, err = os.OpenFile(e.segmentPath(last)+logCompactSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	rec := newLogRecord()
+	flush := func() error {
+		n, err := writeLogRecord(f, size, rec)
+		if err != nil {
+			return err
+		}
+		size += n
+		rec = newLogRecord()
+		return nil
+	}
+
+	var names []string
+	for name := range sealed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rec.reset()
+	for _, name := range names {
+		rec.createBucket([]byte(name))
+		rec.setSequence([]byte(name), sealed[name])
+	}
+
+	for i, id := range ids {
+		_, damaged, err := readLog(files[i], func(payload []byte, at int64) error {
+			e.mu.RLock()
+			defer e.mu.RUnlock()
+
+			return walkLog(payload, func(o *logOp) error {
+				if o.op != logOpPut {
+					return nil
+				}
+
+				b := e.index[string(o.name)]
+				if b == nil {
+					return nil
+				}
+				from := encodeLogLoc(id, at+int64(o.off), len(o.value))
+				if loc, ok := b.get(string(o.key)); !ok || !bytes.Equal(loc, from) {
+					return nil
+				}
+
+				off := rec.put(o.name, o.key, o.value)
+				moved = append(moved, logMove{
+					name: string(o.name),
+					key:  string(o.key),
+					from: from,
+					to:   encodeLogLoc(last, size+off, len(o.value)),
+				})
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, nil, 0, err
+		} else if damaged {
+			return nil, nil, 0, fmt.Errorf("%w: segment %d is damaged", errCorruptLog, id)
+		}
+
+		if len(rec.buf) >= logCompactRecordSize {
+			if err := flush(); err != nil {
+				return nil, nil, 0, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, nil, 0, err
+	}
+	return f, moved, size, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// logRecord is a record of the log being built. The buffer starts with
+// the space for the header, so the offsets in it are relative to the record.
+type logRecord struct {
+	buf []byte
+}
+
+func newLogRecord() *logRecord {
+	return &logRecord{buf: make([]byte, logHeaderSize)}
+}
+
+func (r *logRecord) empty() bool {
+	return len(r.buf) == logHeaderSize
+}
+
+func (r *logRecord) bytes(b []byte) {
+	r.buf = binary.AppendUvarint(r.buf, uint64(len(b)))
+	r.buf = append(r.buf, b...)
+}
+
+func (r *logRecord) op(op byte, name []byte) {
+	r.buf = append(r.buf, op)
+	r.bytes(name)
+}
+
+func (r *logRecord) reset() {
+	r.op(logOpReset, nil)
+}
+
+func (r *logRecord) createBucket(name []byte) {
+	r.op(logOpCreateBucket, name)
+}
+
+func (r *logRecord) deleteBucket(name []byte) {
+	r.op(logOpDeleteBucket, name)
+}
+
+// put returns the offset of the value in the record.
+func (r *logRecord) put(name, key, value []byte) int64 {
+	r.op(logOpPut, name)
+	r.bytes(key)
+	r.buf = binary.AppendUvarint(r.buf, uint64(len(value)))
+	off := int64(len(r.buf))
+	r.buf = append(r.buf, value...)
+	return off
+}
+
+func (r *logRecord) delete(name, key []byte) {
+	r.op(logOpDelete, name)
+	r.bytes(key)
+}
+
+func (r *logRecord) setSequence(name []byte, v uint64) {
+	r.op(logOpSetSequence, name)
+	r.buf = binary.AppendUvarint(r.buf, v)
+}
+
+// writeLogRecord fills the header of the record and writes it to f at the offset.
+func writeLogRecord(f *os.File, at int64, r *logRecord) (int64, error) {
+	payload := r.buf[logHeaderSize:]
+	binary.BigEndian.PutUint32(r.buf, uint32(len(payload)))
+	binary.BigEndian.PutUint32(r.buf[4:], crc32.ChecksumIEEE(payload))
+
+	if _, err := f.WriteAt(r.buf, at); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return int64(len(r.buf)), nil
+}
+
+// logOp is an operation decoded from a log record.
+type logOp struct {
+	op         byte
+	name       []byte
+	key, value []byte
+	// off is the offset of the value in the payload.
+	off int
+	seq uint64
+}
+
+// walkLog calls fn for the operations from the payload of the record.
+func walkLog(payload []byte, fn func(o *logOp) error) error {
+	p := payload
+
+	next := func() ([]byte, bool) {
+		n, l := binary.Uvarint(p)
+		if l <= 0 || uint64(len(p)-l) < n {
+			return nil, false
+		}
+		b := p[l : l+int(n)]
+		p = p[l+int(n):]
+		return b, true
+	}
+
+	for len(p) > 0 {
+		o := logOp{op: p[0]}
+		p = p[1:]
+
+		var ok bool
+		if o.name, ok = next(); !ok {
+			return errCorruptLog
+		}
+
+		switch o.op {
+		case logOpCreateBucket, logOpDeleteBucket, logOpReset:
+		case logOpPut:
+			if o.key, ok = next(); !ok {
+				return errCorruptLog
+			}
+			if o.value, ok = next(); !ok {
+				return errCorruptLog
+			}
+			o.off = len(payload) - len(p) - len(o.value)
+		case logOpDelete:
+			if o.key, ok = next(); !ok {
+				return errCorruptLog
+			}
+		case logOpSetSequence:
+			v, l := binary.Uvarint(p)
+			if l <= 0 {
+				return errCorruptLog
+			}
+			p = p[l:]
+			o.seq = v
+		default:
+			return fmt.Errorf("%w: unknown operation %d", errCorruptLog, o.op)
+		}
+
+		if err := fn(&o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayLog applies the operations from the payload of the record
+// that is stored in the segment at the offset to the index.
+func replayLog(index map[string]*memBucket, payload []byte, seg uint32, at int64) error {
+	return walkLog(payload, func(o *logOp) error {
+		name := string(o.name)
+
+		switch o.op {
+		case logOpCreateBucket:
+			if index[name] == nil {
+				index[name] = newMemBucket()
+			}
+			return nil
+		case logOpDeleteBucket:
+			delete(index, name)
+			return nil
+		case logOpReset:
+			for name := range index {
+				delete(index, name)
+			}
+			return nil
+		}
+
+		b := index[name]
+		if b == nil {
+			return fmt.Errorf("%w: bucket %q does not exist", errCorruptLog, name)
+		}
+
+		switch o.op {
+		case logOpPut:
+			b.put(string(o.key), encodeLogLoc(seg, at+int64(o.off), len(o.value)))
+		case logOpDelete:
+			b.delete(string(o.key))
+		case logOpSetSequence:
+			b.seq = o.seq
+		}
+		return nil
+	})
+}
+
+// encodeLogLoc returns the position of the value in the log that is stored in the index.
+func encodeLogLoc(seg uint32, off int64, n int) []byte {
+	loc := make([]byte, 16)
+	binary.BigEndian.PutUint32(loc, seg)
+	binary.BigEndian.PutUint64(loc[4:], uint64(off))
+	binary.BigEndian.PutUint32(loc[12:], uint32(n))
+	return loc
+}
+
+func decodeLogLoc(loc []byte) (seg uint32, off int64, n int) {
+	return binary.BigEndian.Uint32(loc), int64(binary.BigEndian.Uint64(loc[4:])), int(binary.BigEndian.Uint32(loc[12:]))
+}
+
+// logStoreTxn is a transaction of the log engine. The changes are recorded
+// to be written to the log on commit, and the transaction sees them on top
+// of the index until they are published to it.
+type logStoreTxn struct {
+	e        *logStore
+	writable bool
+	// buckets are the buckets used by the transaction, nil for the deleted ones.
+	buckets map[string]*logTxnBucket
+	// start is the offset the record of the transaction is written at.
+	start int64
+	rec   *logRecord
+}
+
+// logTxnBucket is the bucket of the index with the changes
+// of the transaction on top of it.
+type logTxnBucket struct {
+	// base is nil if the bucket was created by the transaction.
+	base *memBucket
+	// changes are the positions of the values written by the transaction,
+	// nil for the deleted keys.
+	changes *memBucket
+	seq     uint64
+}
+
+// seek returns the first key of the bucket that is not less than key,
+// or greater than key if after is set.
+func (b *logTxnBucket) seek(key string, after bool) *memNode {
+	from := func(m *memBucket) *memNode {
+		if m == nil {
+			return nil
+		} else if after {
+			return m.next(key)
+		}
+		return m.seek(key, nil)
+	}
+
+	for {
+		n, c := from(b.base), from(b.changes)
+		if c == nil || n != nil && n.key < c.key {
+			return n
+		} else if c.value != nil {
+			return c
+		}
+		// The key is deleted by the transaction.
+		key, after = c.key, true
+	}
+}
+
+// value reads the value from the log or from the record of the transaction.
+// It panics if the log cannot be read, like bbolt does on I/O errors of mmap.
+func (t *logStoreTxn) value(loc []byte) []byte {
+	if loc == nil {
+		return nil
+	}
+
+	seg, off, n := decodeLogLoc(loc)
+	v := make([]byte, n)
+	if seg == t.e.active && off >= t.start {
+		copy(v, t.rec.buf[off-t.start:])
+		return v
+	}
+
+	if _, err := t.e.segs[seg].ReadAt(v, off); err != nil {
+		panic(fmt.Sprintf("reading %d bytes at %d from the segment %d of the log %q: %v", n, off, seg, t.e.path, err))
+	}
+	return v
+}
+
+func (t *logStoreTxn) bucket(name []byte) *logTxnBucket {
+	if b, ok := t.buckets[string(name)]; ok {
+		return b
+	}
+
+	base := t.e.index[string(name)]
+	if base == nil {
+		return nil
+	}
+
+	b := &logTxnBucket{base: base, seq: base.seq}
+	t.setBucket(name, b)
+	return b
+}
+
+func (t *logStoreTxn) setBucket(name []byte, b *logTxnBucket) {
+	if t.buckets == nil {
+		t.buckets = make(map[string]*logTxnBucket)
+	}
+	t.buckets[string(name)] = b
+}
+
+func (t *logStoreTxn) Bucket(name []byte) bucket {
+	b := t.bucket(name)
+	if b == nil {
+		return nil
+	}
+	return &logStoreBucket{t: t, b: b, name: name}
+}
+
+func (t *logStoreTxn) CreateBucketIfNotExists(name []byte) (bucket, error) {
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+	if !t.writable {
+		return nil, errTxNotWritable
+	}
+
+	b := &logTxnBucket{}
+	t.setBucket(name, b)
+	t.rec.createBucket(name)
+	return &logStoreBucket{t: t, b: b, name: name}, nil
+}
+
+func (t *logStoreTxn) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+	if t.bucket(name) == nil {
+		return nil
+	}
+
+	t.setBucket(name, nil)
+	t.rec.deleteBucket(name)
+	return nil
+}
+
+// logStoreBucket is the bucket accessed in a transaction of the log engine.
+// The buckets of the index store the positions of the values in the log.
+type logStoreBucket struct {
+	t    *logStoreTxn
+	b    *logTxnBucket
+	name []byte
+}
+
+// loc returns the position of the value of the key or nil if there is no such key.
+func (b *logStoreBucket) loc(key []byte) []byte {
+	if b.b.changes != nil {
+		if loc, ok := b.b.changes.get(string(key)); ok {
+			return loc
+		}
+	}
+	if b.b.base != nil {
+		loc, _ := b.b.base.get(string(key))
+		return loc
+	}
+	return nil
+}
+
+// change records the new position of the value of the key, nil if it is deleted.
+func (b *logStoreBucket) change(key, loc []byte) {
+	if b.b.changes == nil {
+		b.b.changes = newMemBucket()
+	}
+	b.b.changes.put(string(key), loc)
+}
+
+func (b *logStoreBucket) Get(key []byte) []byte {
+	return b.t.value(b.loc(key))
+}
+
+func (b *logStoreBucket) Put(key, value []byte) error {
+	if !b.t.writable {
+		return errTxNotWritable
+	}
+
+	off := b.t.start + b.t.rec.put(b.name, key, value)
+	b.change(key, encodeLogLoc(b.t.e.active, off, len(value)))
+	return nil
+}
+
+func (b *logStoreBucket) Delete(key []byte) error {
+	if !b.t.writable {
+		return errTxNotWritable
+	}
+	if b.loc(key) == nil {
+		return nil
+	}
+
+	b.t.rec.delete(b.name, key)
+	b.change(key, nil)
+	return nil
+}
+
+func (b *logStoreBucket) Cursor() cursor {
+	return &logStoreCursor{b: b}
+}
+
+func (b *logStoreBucket) ForEach(fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *logStoreBucket) NextSequence() (uint64, error) {
+	v := b.Sequence() + 1
+	if err := b.SetSequence(v); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+func (b *logStoreBucket) Sequence() uint64 {
+	return b.b.seq
+}
+
+func (b *logStoreBucket) SetSequence(v uint64) error {
+	if !b.t.writable {
+		return errTxNotWritable
+	}
+
+	b.b.seq = v
+	b.t.rec.setSequence(b.name, v)
+	return nil
+}
+
+// logStoreCursor reads the values of the keys from the log. It remembers
+// the current key rather than its node, so that it stays valid when
+// the keys are changed during the iteration.
+type logStoreCursor struct {
+	b   *logStoreBucket
+	key string
+}
+
+func (c *logStoreCursor) seek(key string, after bool) ([]byte, []byte) {
+	n := c.b.b.seek(key, after)
+	if n == nil {
+		return nil, nil
+	}
+	c.key = n.key
+	return []byte(n.key), c.b.t.value(n.value)
+}
+
+func (c *logStoreCursor) First() ([]byte, []byte) {
+	return c.seek("", false)
+}
+
+func (c *logStoreCursor) Next() ([]byte, []byte) {
+	return c.seek(c.key, true)
+}
+
+func (c *logStoreCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.seek(string(seek), false)
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogStoreCompact(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "kvdb.log")
+
+	d, closeFunc, err := Open(EngineLog, name, false)
+	if err != nil {
+		t.Fatalf("Could not open the log database: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"party", "us"} {
+			if err := d.SetKey(key, []byte(fmt.Sprintf("value %d", i))); err != nil {
+				t.Fatalf("SetKey(%q): %v", key, err)
+			}
+		}
+	}
+	if err := d.DeleteKey("us"); err != nil {
+		t.Fatalf(`DeleteKey("us"): %v`, err)
+	}
+	// The replication log keeps the writes until the replica acknowledges them.
+	if err := d.SetReplicas([]string{"replica"}); err != nil {
+		t.Fatalf("SetReplicas(): %v", err)
+	}
+	if err := d.AckReplication("replica", 201); err != nil {
+		t.Fatalf("AckReplication(): %v", err)
+	}
+
+	before := logSize(t, name)
+	if err := d.db.(*logStore).compact(); err != nil {
+		t.Fatalf("compact(): %v", err)
+	}
+	if after := logSize(t, name); after*10 > before {
+		t.Errorf("Log size after compaction: got %d bytes, want less than a tenth of %d bytes", after, before)
+	}
+
+	check := func(d *Database) {
+		t.Helper()
+
+		if value, err := d.GetKey("party"); err != nil || string(value) != "value 99" {
+			t.Errorf(`GetKey("party"): got %q, %v; want %q, nil`, value, err, "value 99")
+		}
+		if value, err := d.GetKey("us"); err != nil || value != nil {
+			t.Errorf(`GetKey("us"): got %q, %v; want nil, nil`, value, err)
+		}
+	}
+
+	check(d)
+	if err := d.SetKey("a", []byte("First")); err != nil {
+		t.Fatalf(`SetKey("a"): %v`, err)
+	}
+	closeFunc()
+
+	d, closeFunc, err = Open(EngineLog, name, false)
+	if err != nil {
+		t.Fatalf("Could not reopen the log database: %v", err)
+	}
+	defer closeFunc()
+
+	check(d)
+	if value, err := d.GetKey("a"); err != nil || string(value) != "First" {
+		t.Errorf(`GetKey("a") after reopening: got %q, %v; want %q, nil`, value, err, "First")
+	}
+}
+
+func TestLogStoreSegments(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "kvdb.log")
+
+	d, closeFunc, err := Open(EngineLog, name, false)
+	if err != nil {
+		t.Fatalf("Could not open the log database: %v", err)
+	}
+	e := d.db.(*logStore)
+	e.segmentSize = 1 << 10
+
+	if err := d.SetReplicas([]string{"replica"}); err != nil {
+		t.Fatalf("SetReplicas(): %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := d.SetKey(fmt.Sprintf("key %d", i%10), []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatalf("SetKey(): %v", err)
+		}
+	}
+	if err := d.DeleteKey("key 0"); err != nil {
+		t.Fatalf(`DeleteKey("key 0"): %v`, err)
+	}
+
+	segments, _ := filepath.Glob(name + ".*")
+	if len(segments) < 2 {
+		t.Fatalf("Sealed segments after the writes: got %q, want at least two", segments)
+	}
+
+	// The writes go on to the new segments while the sealed ones are compacted.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := d.SetKey("key 1", []byte(fmt.Sprintf("new value %d", i))); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := e.compact(); err != nil {
+		t.Fatalf("compact(): %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("SetKey() during compaction: %v", err)
+	}
+
+	check := func(d *Database) {
+		t.Helper()
+
+		if value, err := d.GetKey("key 0"); err != nil || value != nil {
+			t.Errorf(`GetKey("key 0"): got %q, %v; want nil, nil`, value, err)
+		}
+		if value, err := d.GetKey("key 1"); err != nil || string(value) != "new value 19" {
+			t.Errorf(`GetKey("key 1"): got %q, %v; want %q, nil`, value, err, "new value 19")
+		}
+		if value, err := d.GetKey("key 9"); err != nil || string(value) != "value 99" {
+			t.Errorf(`GetKey("key 9"): got %q, %v; want %q, nil`, value, err, "value 99")
+		}
+		if seq, err := d.LastSeq(); err != nil || seq != 121 {
+			t.Errorf("LastSeq(): got %d, %v; want %d, nil", seq, err, 121)
+		}
+	}
+
+	check(d)
+	closeFunc()
+
+	d, closeFunc, err = Open(EngineLog, name, false)
+	if err != nil {
+		t.Fatalf("Could not reopen the log database: %v", err)
+	}
+	defer closeFunc()
+
+	check(d)
+}
+
+// logSize returns the total size of the segments of the log.
+func logSize(t *testing.T, name string) int64 {
+	t.Helper()
+
+	segments, err := filepath.Glob(name + "*")
+	if err != nil {
+		t.Fatalf("Glob(%q): %v", name, err)
+	}
+
+	var size int64
+	for _, s := range segments {
+		st, err := os.Stat(s)
+		if err != nil {
+			t.Fatalf("Stat(%q): %v", s, err)
+		}
+		size += st.Size()
+	}
+	return size
+}
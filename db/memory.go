@@ -0,0 +1,309 @@
+package db
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+var errTxNotWritable = errors.New("tx not writable")
+
+// memoryEngine is the engine that keeps the buckets in memory.
+// The data is lost when the process exits, so it is meant for tests
+// and ephemeral caches. Writers are serialized and block the readers.
+type memoryEngine struct {
+	mu      sync.RWMutex
+	buckets map[string]*memBucket
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{buckets: make(map[string]*memBucket)}
+}
+
+func (e *memoryEngine) Update(fn func(txn) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t := &memTxn{e: e, writable: true}
+	if err := fn(t); err != nil {
+		t.rollback()
+		return err
+	}
+	return nil
+}
+
+func (e *memoryEngine) View(fn func(txn) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return fn(&memTxn{e: e})
+}
+
+func (e *memoryEngine) Close() error {
+	return nil
+}
+
+// memTxn is a transaction of the memory engine. The changes are applied
+// right away, and the undo log reverts them if the transaction fails.
+type memTxn struct {
+	e        *memoryEngine
+	writable bool
+	undo     []func()
+}
+
+func (t *memTxn) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+func (t *memTxn) Bucket(name []byte) bucket {
+	b, ok := t.e.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	return &memBucketTxn{t: t, b: b}
+}
+
+func (t *memTxn) CreateBucketIfNotExists(name []byte) (bucket, error) {
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+	if !t.writable {
+		return nil, errTxNotWritable
+	}
+
+	b := newMemBucket()
+	t.e.buckets[string(name)] = b
+	t.undo = append(t.undo, func() { delete(t.e.buckets, string(name)) })
+	return &memBucketTxn{t: t, b: b}, nil
+}
+
+func (t *memTxn) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+
+	b, ok := t.e.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+
+	delete(t.e.buckets, string(name))
+	t.undo = append(t.undo, func() { t.e.buckets[string(name)] = b })
+	return nil
+}
+
+// memMaxLevel is the maximum number of levels of the skip list in a bucket.
+// Every node is promoted to the next level with the 1/4 chance,
+// so it is enough for billions of keys.
+const memMaxLevel = 16
+
+// memNode is a key of the bucket. The node of a deleted key is marked,
+// so that the cursors that stand on it look the next key up again.
+type memNode struct {
+	key     string
+	value   []byte
+	next    []*memNode
+	deleted bool
+}
+
+// memBucket is a bucket with the keys kept in a skip list, so that the
+// lookups, writes and deletions take O(log n) time.
+type memBucket struct {
+	head  memNode
+	level int
+	seq   uint64
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{head: memNode{next: make([]*memNode, memMaxLevel)}, level: 1}
+}
+
+// seek returns the first node with the key that is not less than key.
+// If path is not nil, it receives the last node before key on every level.
+func (b *memBucket) seek(key string, path *[memMaxLevel]*memNode) *memNode {
+	x := &b.head
+	for i := b.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if path != nil {
+			path[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// next returns the first node with the key that is greater than key.
+func (b *memBucket) next(key string) *memNode {
+	n := b.seek(key, nil)
+	if n != nil && n.key == key {
+		n = n.next[0]
+	}
+	return n
+}
+
+func (b *memBucket) get(key string) ([]byte, bool) {
+	if n := b.seek(key, nil); n != nil && n.key == key {
+		return n.value, true
+	}
+	return nil, false
+}
+
+func randomLevel() int {
+	level := 1
+	for level < memMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+func (b *memBucket) put(key string, value []byte) {
+	var path [memMaxLevel]*memNode
+	if n := b.seek(key, &path); n != nil && n.key == key {
+		n.value = value
+		return
+	}
+
+	level := randomLevel()
+	for ; b.level < level; b.level++ {
+		path[b.level] = &b.head
+	}
+
+	n := &memNode{key: key, value: value, next: make([]*memNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = path[i].next[i]
+		path[i].next[i] = n
+	}
+}
+
+func (b *memBucket) delete(key string) {
+	var path [memMaxLevel]*memNode
+	n := b.seek(key, &path)
+	if n == nil || n.key != key {
+		return
+	}
+
+	for i := range n.next {
+		path[i].next[i] = n.next[i]
+	}
+	n.deleted = true
+}
+
+// memBucketTxn is the bucket accessed in a transaction.
+type memBucketTxn struct {
+	t *memTxn
+	b *memBucket
+}
+
+func (b *memBucketTxn) Get(key []byte) []byte {
+	v, _ := b.b.get(string(key))
+	return v
+}
+
+func (b *memBucketTxn) Put(key, value []byte) error {
+	if !b.t.writable {
+		return errTxNotWritable
+	}
+
+	k := string(key)
+	old, ok := b.b.get(k)
+	b.b.put(k, append([]byte{}, value...))
+
+	b.t.undo = append(b.t.undo, func() {
+		if ok {
+			b.b.put(k, old)
+		} else {
+			b.b.delete(k)
+		}
+	})
+	return nil
+}
+
+func (b *memBucketTxn) Delete(key []byte) error {
+	if !b.t.writable {
+		return errTxNotWritable
+	}
+
+	k := string(key)
+	old, ok := b.b.get(k)
+	if !ok {
+		return nil
+	}
+	b.b.delete(k)
+
+	b.t.undo = append(b.t.undo, func() { b.b.put(k, old) })
+	return nil
+}
+
+func (b *memBucketTxn) Cursor() cursor {
+	return &memCursor{b: b.b}
+}
+
+func (b *memBucketTxn) ForEach(fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memBucketTxn) NextSequence() (uint64, error) {
+	if err := b.SetSequence(b.b.seq + 1); err != nil {
+		return 0, err
+	}
+	return b.b.seq, nil
+}
+
+func (b *memBucketTxn) Sequence() uint64 {
+	return b.b.seq
+}
+
+func (b *memBucketTxn) SetSequence(v uint64) error {
+	if !b.t.writable {
+		return errTxNotWritable
+	}
+
+	old := b.b.seq
+	b.b.seq = v
+	b.t.undo = append(b.t.undo, func() { b.b.seq = old })
+	return nil
+}
+
+// memCursor stands on the node of the current key. If the key is deleted
+// during the iteration, the cursor looks up the key after it, so that
+// it stays valid when the keys are changed.
+type memCursor struct {
+	b *memBucket
+	n *memNode
+}
+
+func (c *memCursor) at(n *memNode) ([]byte, []byte) {
+	if n == nil {
+		return nil, nil
+	}
+	c.n = n
+	return []byte(n.key), n.value
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	return c.at(c.b.head.next[0])
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	if c.n == nil {
+		return c.First()
+	}
+	if !c.n.deleted {
+		return c.at(c.n.next[0])
+	}
+	return c.at(c.b.next(c.n.key))
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(c.b.seek(string(seek), nil))
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// metaBucket contains the metadata of the keys from the default namespace.
+var metaBucket = []byte("meta")
+
+// Meta is the metadata stored together with the value of the key.
+// Version is the sequence number of the change that has written the key,
+// so it grows with every write and is the same on the leader and its replicas.
+// Expires is the time after which the key is considered deleted,
+// or zero if the key does not expire.
+// The keys written before the metadata was introduced have zero Meta.
+type Meta struct {
+	Version     uint64
+	Modified    time.Time
+	ContentType string `json:",omitempty"`
+	Expires     time.Time
+}
+
+// Expired reports whether the key with the metadata has expired by the time t.
+func (m Meta) Expired(t time.Time) bool {
+	return !m.Expires.IsZero() && !t.Before(m.Expires)
+}
+
+// ETag returns the entity tag of the key version.
+func (m Meta) ETag() string {
+	return strconv.FormatUint(m.Version, 10)
+}
+
+func (n *namespace) getMeta(key string) (Meta, error) {
+	var m Meta
+
+	buf := n.meta.Get([]byte(key))
+	if buf == nil {
+		return m, nil
+	}
+
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return Meta{}, fmt.Errorf("decoding metadata of key %q: %w", key, err)
+	}
+	return m, nil
+}
+
+// get returns the value of the key with its metadata.
+// The value is nil if the key does not exist or has expired.
+func (n *namespace) get(key string) ([]byte, Meta, error) {
+	value := n.data.Get([]byte(key))
+	if value == nil {
+		return nil, Meta{}, nil
+	}
+
+	m, err := n.getMeta(key)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+
+	if m.Expired(now()) {
+		return nil, Meta{}, nil
+	}
+	return value, m, nil
+}
+
+// put stores the value of the key together with its metadata.
+func (n *namespace) put(key string, value []byte, m Meta) error {
+	if err := n.unindexExpiry(key); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := n.data.Put([]byte(key), value); err != nil {
+		return err
+	}
+	if err := n.meta.Put([]byte(key), buf); err != nil {
+		return err
+	}
+	return n.indexExpiry(key, m.Expires)
+}
+
+// delete deletes the value of the key together with its metadata
+// and appends the deletion to the replication log.
+func (n *namespace) delete(key string) error {
+	if err := n.remove(key); err != nil {
+		return err
+	}
+
+	_, err := appendLog(n.tx, LogEntry{Op: OpDelete, Namespace: n.name, Key: key})
+	return err
+}
+
+// remove deletes the value of the key together with its metadata.
+func (n *namespace) remove(key string) error {
+	if err := n.unindexExpiry(key); err != nil {
+		return err
+	}
+
+	if err := n.data.Delete([]byte(key)); err != nil {
+		return err
+	}
+	return n.meta.Delete([]byte(key))
+}
+
+// set stores the value of the key with the content type, modification
+// and expiration time from m and appends the change to the replication log.
+// The version of the key is the sequence number of the change.
+func (n *namespace) set(key string, value []byte, m Meta) (Meta, error) {
+	seq, err := appendLog(n.tx, LogEntry{
+		Op:          OpSet,
+		Namespace:   n.name,
+		Key:         key,
+		Value:       value,
+		Modified:    m.Modified,
+		ContentType: m.ContentType,
+		Expires:     m.Expires,
+	})
+	if err != nil {
+		return Meta{}, err
+	}
+
+	m.Version = seq
+	return m, n.put(key, value, m)
+}
+
+// now returns the modification time for the writes.
+// The time is in UTC so that it is the same after replication.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// GetKeyMeta returns the value of the key together with its metadata.
+// The value is nil if the key does not exist or has expired.
+func (d *Database) GetKeyMeta(key string) ([]byte, Meta, error) {
+	var value []byte
+	var m Meta
+
+	err := d.db.View(func(tx txn) error {
+		n, err := d.namespace(tx)
+		if err != nil {
+			return err
+		}
+
+		v, meta, err := n.get(key)
+		value, m = copyByteSlice(v), meta
+		return err
+	})
+
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	return value, m, nil
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// namespacesBucket lists the namespaces created in addition to the default one.
+var namespacesBucket = []byte("namespaces")
+
+var (
+	// ErrNoNamespace is returned for the operations in a namespace that does not exist.
+	ErrNoNamespace = errors.New("namespace does not exist")
+	// ErrInvalidNamespace is returned when the namespace name is not valid.
+	ErrInvalidNamespace = errors.New("invalid namespace name")
+)
+
+var namespaceRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// namespace is the set of buckets that store the keys of a namespace
+// within a transaction. The default namespace has an empty name.
+type namespace struct {
+	tx     txn
+	name   string
+	data   bucket
+	meta   bucket
+	expiry bucket
+}
+
+// namespaceBuckets returns the names of the buckets with the values,
+// the metadata and the expiry index of the keys in the namespace.
+// The default namespace uses the buckets that predate namespaces.
+func namespaceBuckets(name string) (data, meta, expiry []byte) {
+	if name == "" {
+		return defaultBucket, metaBucket, expiryBucket
+	}
+	return []byte("ns:" + name), []byte("ns-meta:" + name), []byte("ns-expiry:" + name)
+}
+
+func openNamespace(tx txn, name string) (*namespace, error) {
+	data, meta, expiry := namespaceBuckets(name)
+
+	n := &namespace{
+		tx:     tx,
+		name:   name,
+		data:   tx.Bucket(data),
+		meta:   tx.Bucket(meta),
+		expiry: tx.Bucket(expiry),
+	}
+	if n.data == nil || n.meta == nil || n.expiry == nil {
+		return nil, fmt.Errorf("%w: %q", ErrNoNamespace, name)
+	}
+	return n, nil
+}
+
+// namespaceNames returns the names of the namespaces other than the default one.
+func namespaceNames(tx txn) []string {
+	var names []string
+	tx.Bucket(namespacesBucket).ForEach(func(k, v []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+	return names
+}
+
+// ValidateNamespace returns ErrInvalidNamespace if the name cannot be used
+// for a new namespace. The names consist of up to 64 letters, digits,
+// dots, dashes and underscores.
+func ValidateNamespace(name string) error {
+	if !namespaceRe.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidNamespace, name)
+	}
+	return nil
+}
+
+// createNamespace creates the buckets of the namespace and
+// reports whether the namespace did not exist before.
+func createNamespace(tx txn, name string) (bool, error) {
+	if err := ValidateNamespace(name); err != nil {
+		return false, err
+	}
+
+	if tx.Bucket(namespacesBucket).Get([]byte(name)) != nil {
+		return false, nil
+	}
+
+	data, meta, expiry := namespaceBuckets(name)
+	for _, b := range [][]byte{data, meta, expiry} {
+		if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Bucket(namespacesBucket).Put([]byte(name), []byte{})
+}
+
+// deleteNamespace deletes the buckets of the namespace and
+// reports whether the namespace existed.
+func deleteNamespace(tx txn, name string) (bool, error) {
+	if name == "" {
+		return false, fmt.Errorf("%w: the default namespace cannot be deleted", ErrInvalidNamespace)
+	}
+
+	if tx.Bucket(namespacesBucket).Get([]byte(name)) == nil {
+		return false, nil
+	}
+
+	data, meta, expiry := namespaceBuckets(name)
+	for _, b := range [][]byte{data, meta, expiry} {
+		if err := tx.DeleteBucket(b); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Bucket(namespacesBucket).Delete([]byte(name))
+}
+
+// In returns the database that reads and writes the keys of the namespace.
+// The empty name is the default namespace. The other namespaces must be
+// created with CreateNamespace, and the operations in the namespaces that
+// do not exist fail with ErrNoNamespace.
+func (d *Database) In(name string) Store {
+	res := *d
+	res.ns = name
+	return &res
+}
+
+// Namespace returns the name of the namespace the database operates in.
+func (d *Database) Namespace() string {
+	return d.ns
+}
+
+func (d *Database) namespace(tx txn) (*namespace, error) {
+	return openNamespace(tx, d.ns)
+}
+
+// Namespaces returns the names of the namespaces other than the default one
+// in the sorted order.
+func (d *Database) Namespaces() ([]string, error) {
+	var names []string
+	err := d.db.View(func(tx txn) error {
+		names = namespaceNames(tx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// CreateNamespace creates the namespace if it does not exist yet.
+// The creation is appended to the replication log.
+func (d *Database) CreateNamespace(name string) error {
+	return d.changeNamespace(OpCreateNamespace, name, createNamespace)
+}
+
+// DeleteNamespace deletes the namespace together with all its keys
+// if it exists. The deletion is appended to the replication log.
+func (d *Database) DeleteNamespace(name string) error {
+	return d.changeNamespace(OpDeleteNamespace, name, deleteNamespace)
+}
+
+func (d *Database) changeNamespace(op Op, name string, fn func(txn, string) (bool, error)) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	var changed bool
+	err := d.db.Update(func(tx txn) error {
+		var err error
+		if changed, err = fn(tx, name); err != nil || !changed {
+			return err
+		}
+
+		_, err = appendLog(tx, LogEntry{Op: op, Namespace: name})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		d.notifyChanged()
+	}
+	return nil
+}
@@ -0,0 +1,431 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// logBucket contains the replication log: the changes keyed by their sequence number.
+var logBucket = []byte("replication-log")
+
+// replicasBucket contains the last sequence number acknowledged by each replica.
+var replicasBucket = []byte("replicas")
+
+// stateBucket contains the sequence number of the last change applied on a replica,
+// and on the leader the sequence number up to which the changes were removed
+// from the replication log. The sequence numbers of the changes may have gaps,
+// so the latter tells the removed changes apart from the ones never made.
+var stateBucket = []byte("state")
+var appliedSeqKey = []byte("applied-seq")
+var prunedSeqKey = []byte("pruned-seq")
+
+// ErrLogTruncated is returned for the changes that were already removed
+// from the replication log. The replica that needs them cannot catch up
+// with the leader by replication and has to be resynced.
+var ErrLogTruncated = errors.New("replication log is truncated")
+
+// Op is the kind of change stored in the replication log.
+type Op string
+
+const (
+	// OpSet sets the key to the value.
+	OpSet Op = "set"
+	// OpDelete deletes the key.
+	OpDelete Op = "delete"
+	// OpCreateNamespace creates the namespace.
+	OpCreateNamespace Op = "create-namespace"
+	// OpDeleteNamespace deletes the namespace with all its keys.
+	OpDeleteNamespace Op = "delete-namespace"
+)
+
+// LogEntry is a single change stored in the replication log.
+// Namespace is the namespace of the key, or the namespace created or deleted.
+// Modified, ContentType and Expires are the metadata of the key set by OpSet.
+type LogEntry struct {
+	Seq         uint64
+	Op          Op
+	Namespace   string `json:",omitempty"`
+	Key         string
+	Value       []byte
+	Modified    time.Time
+	ContentType string `json:",omitempty"`
+	Expires     time.Time
+}
+
+func encodeSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func decodeSeq(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// appendLog appends the change to the replication log and returns
+// the next sequence number assigned to it. Without registered replicas
+// nobody reads the log, so only the sequence number is advanced.
+func appendLog(tx txn, e LogEntry) (uint64, error) {
+	b := tx.Bucket(logBucket)
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	e.Seq = seq
+
+	if k, _ := tx.Bucket(replicasBucket).Cursor().First(); k == nil {
+		return seq, setPrunedSeq(tx, seq)
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	return seq, b.Put(encodeSeq(seq), buf)
+}
+
+// changes notifies about the changes appended to the replication log.
+// It is shared by all namespaces of the database.
+type changes struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// Changed returns a channel that is closed when the next change
+// is appended to the replication log.
+func (d *Database) Changed() <-chan struct{} {
+	d.changes.mu.Lock()
+	defer d.changes.mu.Unlock()
+	return d.changes.ch
+}
+
+func (d *Database) notifyChanged() {
+	d.changes.mu.Lock()
+	defer d.changes.mu.Unlock()
+	close(d.changes.ch)
+	d.changes.ch = make(chan struct{})
+}
+
+// SetReplicas makes the leader keep the changes in the replication log
+// until all of the provided replicas acknowledge them.
+// Replicas that are not in the list are forgotten, and the changes
+// they held are removed from the log.
+func (d *Database) SetReplicas(names []string) error {
+	return d.db.Update(func(tx txn) error {
+		b := tx.Bucket(replicasBucket)
+
+		want := make(map[string]bool, len(names))
+		for _, name := range names {
+			if name == "" {
+				return errors.New("replica name must not be empty")
+			}
+
+			want[name] = true
+			if b.Get([]byte(name)) == nil {
+				if err := b.Put([]byte(name), encodeSeq(0)); err != nil {
+					return err
+				}
+			}
+		}
+
+		var stale [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if !want[string(k)] {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return pruneLog(tx)
+	})
+}
+
+// setPrunedSeq records that the changes up to seq were removed from the replication log.
+func setPrunedSeq(tx txn, seq uint64) error {
+	state := tx.Bucket(stateBucket)
+	if seq <= decodeSeq(state.Get(prunedSeqKey)) {
+		return nil
+	}
+	return state.Put(prunedSeqKey, encodeSeq(seq))
+}
+
+// pruneLog removes the changes that were acknowledged by all registered
+// replicas from the replication log, or all changes if there are no replicas.
+func pruneLog(tx txn) error {
+	log := tx.Bucket(logBucket)
+
+	minSeq := uint64(math.MaxUint64)
+	tx.Bucket(replicasBucket).ForEach(func(k, v []byte) error {
+		if s := decodeSeq(v); s < minSeq {
+			minSeq = s
+		}
+		return nil
+	})
+	if minSeq > log.Sequence() {
+		minSeq = log.Sequence()
+	}
+
+	var acked [][]byte
+	c := log.Cursor()
+	for k, _ := c.First(); k != nil && decodeSeq(k) <= minSeq; k, _ = c.Next() {
+		acked = append(acked, k)
+	}
+
+	for _, k := range acked {
+		if err := log.Delete(k); err != nil {
+			return err
+		}
+	}
+	return setPrunedSeq(tx, minSeq)
+}
+
+// GetNextKeyForReplication returns the first change in the replication log
+// with the sequence number greater than after.
+// If there are no such changes, nil entry will be returned.
+func (d *Database) GetNextKeyForReplication(after uint64) (*LogEntry, error) {
+	entries, err := d.GetNextKeysForReplication(after, 1, 0)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[0], nil
+}
+
+// GetNextKeysForReplication returns up to limit changes from the replication log
+// with the sequence numbers greater than after.
+// If maxBytes is positive, the changes are also limited by the total size of
+// their keys and values, but at least one change is always returned if present.
+// ErrLogTruncated is returned if the change following after was already removed
+// from the log, e.g. for a replica that was registered after that.
+func (d *Database) GetNextKeysForReplication(after uint64, limit int, maxBytes int) ([]LogEntry, error) {
+	var res []LogEntry
+
+	err := d.db.View(func(tx txn) error {
+		var size int
+
+		if pruned := decodeSeq(tx.Bucket(stateBucket).Get(prunedSeqKey)); after < pruned {
+			return fmt.Errorf("%w: the changes up to %d were removed", ErrLogTruncated, pruned)
+		}
+
+		c := tx.Bucket(logBucket).Cursor()
+		for k, v := c.Seek(encodeSeq(after + 1)); k != nil && len(res) < limit; k, v = c.Next() {
+			var e LogEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("decoding log entry %d: %w", decodeSeq(k), err)
+			}
+			e.Seq = decodeSeq(k)
+
+			size += len(e.Key) + len(e.Value)
+			if maxBytes > 0 && size > maxBytes && len(res) > 0 {
+				break
+			}
+
+			res = append(res, e)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// AckReplication records that the replica has applied all changes up to
+// and including seq. The changes that were acknowledged by all registered
+// replicas are removed from the replication log.
+func (d *Database) AckReplication(replica string, seq uint64) error {
+	return d.db.Update(func(tx txn) error {
+		replicas := tx.Bucket(replicasBucket)
+
+		cur := replicas.Get([]byte(replica))
+		if cur == nil {
+			return fmt.Errorf("replica %q is not registered", replica)
+		}
+
+		if seq > decodeSeq(cur) {
+			if err := replicas.Put([]byte(replica), encodeSeq(seq)); err != nil {
+				return err
+			}
+		}
+
+		return pruneLog(tx)
+	})
+}
+
+// LastSeq returns the sequence number of the latest change in the replication log.
+func (d *Database) LastSeq() (uint64, error) {
+	var seq uint64
+	err := d.db.View(func(tx txn) error {
+		seq = tx.Bucket(logBucket).Sequence()
+		return nil
+	})
+	return seq, err
+}
+
+// ApplyLogEntry applies the change from the leader replication log and
+// remembers its sequence number. Changes that were already applied are ignored.
+// This method is intended to be used only on replicas.
+func (d *Database) ApplyLogEntry(e LogEntry) error {
+	return d.ApplyLogEntries([]LogEntry{e})
+}
+
+// ApplyLogEntries applies the changes from the leader replication log in
+// a single transaction and remembers the sequence number of the last one.
+// The keys get the same versions as on the leader, and the namespaces
+// are created and deleted together with the leader.
+// Changes that were already applied are ignored.
+// This method is intended to be used only on replicas.
+func (d *Database) ApplyLogEntries(entries []LogEntry) error {
+	return d.db.Update(func(tx txn) error {
+		state := tx.Bucket(stateBucket)
+		applied := decodeSeq(state.Get(appliedSeqKey))
+
+		for _, e := range entries {
+			if e.Seq <= applied {
+				continue
+			}
+
+			if err := applyLogEntry(tx, e); err != nil {
+				return err
+			}
+			applied = e.Seq
+		}
+
+		return state.Put(appliedSeqKey, encodeSeq(applied))
+	})
+}
+
+// applyLogEntry applies a single change from the leader replication log.
+func applyLogEntry(tx txn, e LogEntry) error {
+	var err error
+	switch e.Op {
+	case OpSet:
+		var n *namespace
+		if n, err = openNamespace(tx, e.Namespace); err == nil {
+			m := Meta{Version: e.Seq, Modified: e.Modified, ContentType: e.ContentType, Expires: e.Expires}
+			err = n.put(e.Key, e.Value, m)
+		}
+	case OpDelete:
+		var n *namespace
+		if n, err = openNamespace(tx, e.Namespace); err == nil {
+			err = n.remove(e.Key)
+		}
+	case OpCreateNamespace:
+		_, err = createNamespace(tx, e.Namespace)
+	case OpDeleteNamespace:
+		_, err = deleteNamespace(tx, e.Namespace)
+	default:
+		return fmt.Errorf("unknown operation %q", e.Op)
+	}
+	if err != nil {
+		return fmt.Errorf("applying log entry %d: %w", e.Seq, err)
+	}
+	return nil
+}
+
+// Snapshot returns all namespaces and keys of the leader together with the
+// sequence number of the last change they include. The namespaces are returned
+// as OpCreateNamespace entries, each followed by OpSet entries for its keys
+// with the versions of the keys as the sequence numbers.
+// A replica that cannot catch up with the leader by replication loads
+// the snapshot with LoadSnapshot and replicates the changes after seq.
+func (d *Database) Snapshot() (seq uint64, entries []LogEntry, err error) {
+	err = d.db.View(func(tx txn) error {
+		seq = tx.Bucket(logBucket).Sequence()
+
+		for _, name := range append([]string{""}, namespaceNames(tx)...) {
+			if name != "" {
+				entries = append(entries, LogEntry{Op: OpCreateNamespace, Namespace: name})
+			}
+
+			n, err := openNamespace(tx, name)
+			if err != nil {
+				return err
+			}
+
+			err = n.data.ForEach(func(k, v []byte) error {
+				m, err := n.getMeta(string(k))
+				if err != nil {
+					return err
+				}
+
+				entries = append(entries, LogEntry{
+					Seq:         m.Version,
+					Op:          OpSet,
+					Namespace:   name,
+					Key:         string(k),
+					Value:       copyByteSlice(v),
+					Modified:    m.Modified,
+					ContentType: m.ContentType,
+					Expires:     m.Expires,
+				})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, nil, err
+	}
+	return seq, entries, nil
+}
+
+// LoadSnapshot replaces all namespaces and keys with the snapshot returned
+// by Snapshot on the leader and remembers seq as the last applied change.
+// This method is intended to be used only on replicas.
+func (d *Database) LoadSnapshot(seq uint64, entries []LogEntry) error {
+	return d.db.Update(func(tx txn) error {
+		for _, name := range namespaceNames(tx) {
+			if _, err := deleteNamespace(tx, name); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range [][]byte{defaultBucket, metaBucket, expiryBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range entries {
+			if err := applyLogEntry(tx, e); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(stateBucket).Put(appliedSeqKey, encodeSeq(seq))
+	})
+}
+
+// AppliedSeq returns the sequence number of the last change applied on a replica.
+func (d *Database) AppliedSeq() (uint64, error) {
+	var seq uint64
+	err := d.db.View(func(tx txn) error {
+		seq = decodeSeq(tx.Bucket(stateBucket).Get(appliedSeqKey))
+		return nil
+	})
+	return seq, err
+}
@@ -0,0 +1,56 @@
+package db
+
+// Engine is the storage engine of the database.
+type Engine string
+
+const (
+	// EngineBolt stores the keys in a bolt database file.
+	EngineBolt Engine = "bolt"
+	// EngineMemory keeps the keys in memory only, e.g. for tests and caches.
+	EngineMemory Engine = "memory"
+	// EngineLog appends the changes to a log file and keeps an index of the keys
+	// in memory. It suits the shards with many writes.
+	EngineLog Engine = "log"
+)
+
+// Store is the key-value storage of a shard together with its replication log.
+// Database implements Store with every storage engine.
+type Store interface {
+	// In returns the store that operates on the keys of the namespace.
+	In(ns string) Store
+	Namespace() string
+	Namespaces() ([]string, error)
+	CreateNamespace(name string) error
+	DeleteNamespace(name string) error
+
+	GetKey(key string) ([]byte, error)
+	GetKeyMeta(key string) ([]byte, Meta, error)
+	GetKeys(keys []string) ([]KeyValue, error)
+	Scan(prefix, start, end string, limit int) (kvs []KeyValue, next string, err error)
+	ExtraKeys(isExtra func(string) bool) ([]string, error)
+
+	SetKey(key string, value []byte) error
+	SetKeyIf(key string, value []byte, cond Condition) error
+	SetKeyWith(key string, value []byte, opts SetOptions) (Meta, error)
+	SetKeys(kvs []KeyValue) error
+	SetKeysIfAbsent(kvs []KeyValue) error
+	Increment(key string, delta int64) (int64, Meta, error)
+
+	DeleteKey(key string) error
+	DeleteKeyIf(key string, cond Condition) error
+	DeleteKeys(keys []string) error
+	DeleteExtraKeys(isExtra func(string) bool) error
+	DeleteExpiredKeys(limit int) (int, error)
+
+	Changed() <-chan struct{}
+	SetReplicas(names []string) error
+	GetNextKeyForReplication(after uint64) (*LogEntry, error)
+	GetNextKeysForReplication(after uint64, limit int, maxBytes int) ([]LogEntry, error)
+	AckReplication(replica string, seq uint64) error
+	LastSeq() (uint64, error)
+	ApplyLogEntry(e LogEntry) error
+	ApplyLogEntries(entries []LogEntry) error
+	AppliedSeq() (uint64, error)
+	Snapshot() (seq uint64, entries []LogEntry, err error)
+	LoadSnapshot(seq uint64, entries []LogEntry) error
+}
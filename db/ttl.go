@@ -0,0 +1,98 @@
+package db
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// expiryBucket is the index of the keys with the expiration time
+// from the default namespace. The index keys are the expiration time
+// in Unix nanoseconds followed by the key, so the keys that expire first come first.
+var expiryBucket = []byte("expiry")
+
+func expiryIndexKey(expires time.Time, key string) []byte {
+	b := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(b, uint64(expires.UnixNano()))
+	copy(b[8:], key)
+	return b
+}
+
+func (n *namespace) indexExpiry(key string, expires time.Time) error {
+	if expires.IsZero() {
+		return nil
+	}
+	return n.expiry.Put(expiryIndexKey(expires, key), nil)
+}
+
+// unindexExpiry removes the current expiration time of the key from the index.
+func (n *namespace) unindexExpiry(key string) error {
+	m, err := n.getMeta(key)
+	if err != nil || m.Expires.IsZero() {
+		return err
+	}
+	return n.expiry.Delete(expiryIndexKey(m.Expires, key))
+}
+
+// deleteExpired deletes up to limit keys that have expired by the time until
+// and returns the number of deleted keys.
+func (n *namespace) deleteExpired(until time.Time, limit int) (int, error) {
+	var keys []string
+
+	c := n.expiry.Cursor()
+	for k, _ := c.First(); k != nil && len(keys) < limit; k, _ = c.Next() {
+		if binary.BigEndian.Uint64(k[:8]) > uint64(until.UnixNano()) {
+			break
+		}
+		keys = append(keys, string(k[8:]))
+	}
+
+	for _, k := range keys {
+		if err := n.delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// DeleteExpiredKeys deletes up to limit keys that have expired in all
+// namespaces in a single transaction and returns the number of deleted keys.
+// The deletions are appended to the replication log, so that the replicas
+// delete the same keys. The expired keys are hidden from reads even before
+// they are deleted.
+func (d *Database) DeleteExpiredKeys(limit int) (int, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	var deleted int
+	err := d.db.Update(func(tx txn) error {
+		until := now()
+
+		names := append([]string{""}, namespaceNames(tx)...)
+		for _, name := range names {
+			if deleted >= limit {
+				break
+			}
+
+			n, err := openNamespace(tx, name)
+			if err != nil {
+				return err
+			}
+
+			cnt, err := n.deleteExpired(until, limit-deleted)
+			if err != nil {
+				return err
+			}
+			deleted += cnt
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if deleted > 0 {
+		d.notifyChanged()
+	}
+	return deleted, nil
+}
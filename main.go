@@ -2,8 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/YuriyNasretdinov/distribkv/config"
 	"github.com/YuriyNasretdinov/distribkv/db"
@@ -12,61 +18,214 @@ import (
 )
 
 var (
-	dbLocation = flag.String("db-location", "", "The path to the bolt db database")
+	dbLocation = flag.String("db-location", "", "The path to the bolt database file or the log file of the log engine, not used by the memory engine")
+	engine     = flag.String("engine", "bolt", "Storage engine: bolt, log or memory")
 	httpAddr   = flag.String("http-addr", "127.0.0.1:8080", "HTTP host and port")
 	configFile = flag.String("config-file", "sharding.toml", "Config file for static sharding")
+	prevConfig = flag.String("previous-config-file", "", "Config file the cluster used before this shard was added, to read the keys that have not been moved to it yet")
 	shard      = flag.String("shard", "", "The name of the shard for the data")
 	replica    = flag.Bool("replica", false, "Whether or not run as a read-only replica")
+
+	readConsistency = flag.String("read-consistency", "leader", "Default consistency of reads: leader, any or bounded-staleness")
+	maxStaleness    = flag.Duration("max-staleness", 5*time.Second, "Default replica lag allowed for bounded-staleness reads")
+	routing         = flag.String("routing", "proxy", "Default handling of the requests for other shards: proxy or redirect")
+	maxValueSize    = flag.Int64("max-value-size", web.DefaultMaxValueSize, "Maximum size of the values in write requests, in bytes")
+	expireInterval  = flag.Duration("expire-interval", time.Second, "How often the leader deletes the expired keys")
 )
 
+// expireBatchSize is the maximum number of expired keys deleted in one transaction.
+const expireBatchSize = 1000
+
 func parseFlags() {
 	flag.Parse()
 
-	if *dbLocation == "" {
+	if *dbLocation == "" && db.Engine(*engine) != db.EngineMemory {
 		log.Fatalf("Must provide db-location")
 	}
 
 	if *shard == "" {
 		log.Fatalf("Must provide shard")
 	}
+
+	if _, err := web.ParseConsistency(*readConsistency); err != nil {
+		log.Fatalf("Invalid read-consistency: %v", err)
+	}
+
+	if _, err := web.ParseRouting(*routing); err != nil {
+		log.Fatalf("Invalid routing: %v", err)
+	}
 }
 
-func main() {
-	parseFlags()
+func parseShards(filename, name string) (*config.Shards, error) {
+	c, err := config.ParseFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %q: %w", filename, err)
+	}
+
+	shards, err := config.ParseConfig(c, name)
+	if err != nil {
+		return nil, fmt.Errorf("parsing shards config: %w", err)
+	}
+	return shards, nil
+}
+
+func loadShards() (*config.Shards, error) {
+	shards, err := parseShards(*configFile, *shard)
+	if err != nil {
+		return nil, err
+	}
+
+	if *replica && !shards.IsReplica(shards.CurIdx, *httpAddr) {
+		return nil, fmt.Errorf("address %q is not listed in replicas for shard %d", *httpAddr, shards.CurIdx)
+	}
+
+	return shards, nil
+}
+
+// reloader swaps the sharding config of a running server.
+type reloader struct {
+	mu  sync.Mutex
+	db  db.Store
+	srv *web.Server
+	cur *config.Shards
+}
+
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shards, err := loadShards()
+	if err != nil {
+		return err
+	}
+
+	changes := config.Changes(r.cur, shards)
+	if len(changes) == 0 {
+		log.Printf("Config reloaded, no changes")
+		return nil
+	}
+
+	if *replica {
+		r.srv.Replication.SetLeader(shards.Addrs[shards.CurIdx], shards.Epoch)
+	} else if err := r.db.SetReplicas(shards.Replicas[shards.CurIdx]); err != nil {
+		return fmt.Errorf("registering replicas: %w", err)
+	}
+
+	r.srv.SetShards(shards)
+	r.cur = shards
+
+	for _, c := range changes {
+		log.Printf("Config changed: %s", c)
+	}
+	return nil
+}
 
-	c, err := config.ParseFile(*configFile)
+// ReloadHandler reloads the sharding config.
+func (r *reloader) ReloadHandler(w http.ResponseWriter, req *http.Request) {
+	err := r.reload()
 	if err != nil {
-		log.Fatalf("Error parsing config %q: %v", *configFile, err)
+		log.Printf("Error reloading config: %v", err)
+	}
+	r.srv.WriteResult(w, req, err)
+}
+
+// reloadOnSignal reloads the sharding config on SIGHUP.
+func (r *reloader) reloadOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	for range ch {
+		if err := r.reload(); err != nil {
+			log.Printf("Error reloading config: %v", err)
+		}
+	}
+}
+
+// sweepExpiredKeys deletes the expired keys in batches every interval.
+// The deletions reach the replicas through the replication log.
+func sweepExpiredKeys(d db.Store, interval time.Duration) {
+	for {
+		n, err := d.DeleteExpiredKeys(expireBatchSize)
+		if err != nil {
+			log.Printf("Error deleting expired keys: %v", err)
+		} else if n == expireBatchSize {
+			continue
+		}
+
+		time.Sleep(interval)
 	}
+}
+
+func main() {
+	parseFlags()
 
-	shards, err := config.ParseShards(c.Shards, *shard)
+	shards, err := loadShards()
 	if err != nil {
-		log.Fatalf("Error parsing shards config: %v", err)
+		log.Fatalf("Error loading config: %v", err)
 	}
 
-	log.Printf("Shard count is %d, current shard: %d", shards.Count, shards.CurIdx)
+	log.Printf("Shard count is %d, current shard: %d, config epoch: %d", shards.Count, shards.CurIdx, shards.Epoch)
 
-	db, close, err := db.NewDatabase(*dbLocation, *replica)
+	db, close, err := db.Open(db.Engine(*engine), *dbLocation, *replica)
 	if err != nil {
 		log.Fatalf("Error creating %q: %v", *dbLocation, err)
 	}
 	defer close()
 
+	srv := web.NewServer(db, shards)
+	srv.DefaultConsistency = web.Consistency(*readConsistency)
+	srv.MaxStaleness = *maxStaleness
+	srv.Addr = *httpAddr
+	srv.MaxValueSize = *maxValueSize
+	srv.DefaultRouting = web.Routing(*routing)
+
 	if *replica {
 		leaderAddr, ok := shards.Addrs[shards.CurIdx]
 		if !ok {
 			log.Fatalf("Could not find address for leader for shard %d", shards.CurIdx)
 		}
-		go replication.ClientLoop(db, leaderAddr)
+		srv.Replication = replication.NewClient(db, leaderAddr, *httpAddr, shards.Epoch)
+		go srv.Replication.Loop()
+	} else {
+		if err := db.SetReplicas(shards.Replicas[shards.CurIdx]); err != nil {
+			log.Fatalf("Error registering replicas: %v", err)
+		}
+		log.Printf("Replicas of the current shard: %q", shards.Replicas[shards.CurIdx])
+		go sweepExpiredKeys(db, *expireInterval)
+
+		if *prevConfig != "" {
+			prev, err := parseShards(*prevConfig, "")
+			if err != nil {
+				log.Fatalf("Error loading previous config: %v", err)
+			}
+			srv.MigrateFrom(prev)
+			log.Printf("Reading the keys that have not been moved yet from the shards in %q", *prevConfig)
+		}
 	}
 
-	srv := web.NewServer(db, shards)
+	r := &reloader{db: db, srv: srv, cur: shards}
+	go r.reloadOnSignal()
 
 	http.HandleFunc("/get", srv.GetHandler)
 	http.HandleFunc("/set", srv.SetHandler)
+	http.HandleFunc("/delete", srv.DeleteHandler)
+	http.HandleFunc("/incr", srv.IncrementHandler)
+	http.HandleFunc("/v1/keys/", srv.KeysHandler)
+	http.HandleFunc("/v1/batch/", srv.BatchHandler)
+	http.HandleFunc("/v1/scan", srv.ScanHandler)
+	http.HandleFunc("/v1/namespaces", srv.NamespacesHandler)
+	http.HandleFunc("/v1/namespaces/", srv.NamespacesHandler)
 	http.HandleFunc("/purge", srv.DeleteExtraKeysHandler)
+	http.HandleFunc("/reshard", srv.ReshardHandler)
+	http.HandleFunc("/migrate-keys", srv.MigrateKeysHandler)
+	http.HandleFunc("/finish-migration", srv.FinishMigrationHandler)
+	http.HandleFunc("/local-get", srv.LocalGetHandler)
 	http.HandleFunc("/next-replication-key", srv.GetNextKeyForReplication)
-	http.HandleFunc("/delete-replication-key", srv.DeleteReplicationKey)
+	http.HandleFunc("/next-replication-keys", srv.GetNextKeysForReplication)
+	http.HandleFunc("/replication-snapshot", srv.ReplicationSnapshot)
+	http.HandleFunc("/ack-replication", srv.AckReplication)
+	http.HandleFunc("/reload-config", r.ReloadHandler)
+	http.HandleFunc("/status", srv.StatusHandler)
 
-	log.Fatal(http.ListenAndServe(*httpAddr, nil))
+	log.Fatal(http.ListenAndServe(*httpAddr, srv.CheckEpoch(http.DefaultServeMux)))
 }
@@ -4,89 +4,357 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/YuriyNasretdinov/distribkv/config"
 	"github.com/YuriyNasretdinov/distribkv/db"
 )
 
 // NextKeyValue contains the response for GetNextKeyForReplication.
+// Seq is zero when there are no new changes.
+// Err is the error message if the request has failed.
+// Value is sent base64-encoded, so arbitrary bytes are replicated as is.
+// Namespace is the namespace of the key, or the namespace created or deleted.
+// Modified, ContentType and Expires are the metadata of the key.
 type NextKeyValue struct {
-	Key   string
-	Value string
-	Err   error
+	Seq         uint64
+	Op          db.Op
+	Namespace   string
+	Key         string
+	Value       []byte
+	Modified    time.Time
+	ContentType string
+	Expires     time.Time
+	Err         string
 }
 
-type client struct {
-	db         *db.Database
+// NextKeyValues contains the response for GetNextKeysForReplication.
+// LastSeq is the sequence number of the latest change on the leader.
+// Truncated is set when the requested changes were already removed
+// from the leader replication log, so the replica has to be resynced.
+type NextKeyValues struct {
+	Entries   []NextKeyValue
+	LastSeq   uint64
+	Truncated bool
+	Err       string
+}
+
+// Snapshot contains the response for the replication snapshot request.
+// Seq is the sequence number of the last change included in the snapshot.
+// Entries are the namespaces and the keys of the leader, and the sequence
+// numbers of the keys are their versions.
+type Snapshot struct {
+	Seq     uint64
+	Entries []NextKeyValue
+	Err     string
+}
+
+// NewNextKeyValues converts the changes from the replication log
+// to the ones sent to the replicas.
+func NewNextKeyValues(entries []db.LogEntry) []NextKeyValue {
+	res := make([]NextKeyValue, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, NextKeyValue{
+			Seq:         e.Seq,
+			Op:          e.Op,
+			Namespace:   e.Namespace,
+			Key:         e.Key,
+			Value:       e.Value,
+			Modified:    e.Modified,
+			ContentType: e.ContentType,
+			Expires:     e.Expires,
+		})
+	}
+	return res
+}
+
+// logEntries converts the changes received from the leader back
+// to the replication log entries.
+func logEntries(kvs []NextKeyValue) []db.LogEntry {
+	res := make([]db.LogEntry, 0, len(kvs))
+	for _, e := range kvs {
+		res = append(res, db.LogEntry{
+			Seq:         e.Seq,
+			Op:          e.Op,
+			Namespace:   e.Namespace,
+			Key:         e.Key,
+			Value:       e.Value,
+			Modified:    e.Modified,
+			ContentType: e.ContentType,
+			Expires:     e.Expires,
+		})
+	}
+	return res
+}
+
+const (
+	// batchSize is the maximum number of changes downloaded at once.
+	batchSize = 1000
+	// batchBytes is the approximate limit of keys and values size downloaded at once.
+	batchBytes = 1 << 20
+	// pollWait is how long the leader holds the request open when there are no changes.
+	// An idle replica hears from the leader at least that often, so its staleness
+	// stays below twice the wait.
+	pollWait = time.Second
+)
+
+// errResyncNeeded is returned when the replica cannot catch up with the leader
+// because the changes it needs were removed from the leader replication log.
+var errResyncNeeded = errors.New("the replica must be resynced from the leader")
+
+var httpClient = &http.Client{
+	Timeout: pollWait + 10*time.Second,
+}
+
+// snapshotClient downloads the snapshots that contain all keys of the leader.
+var snapshotClient = &http.Client{
+	Timeout: 10 * time.Minute,
+}
+
+// Client downloads the changes from the leader and applies them on a replica.
+type Client struct {
+	db   db.Store
+	name string
+
+	mu         sync.Mutex
 	leaderAddr string
+	epoch      int64
+	caughtUpAt time.Time
+	stopped    bool
+
+	done chan struct{}
+}
+
+// NewClient creates a replication client for the leader at leaderAddr.
+// The name identifies the replica on the leader so that the leader keeps
+// the changes until every replica acknowledges them.
+// The leader rejects the requests if its config epoch differs from the provided one.
+func NewClient(db db.Store, leaderAddr string, name string, epoch int64) *Client {
+	return &Client{db: db, leaderAddr: leaderAddr, name: name, epoch: epoch, done: make(chan struct{})}
 }
 
-// ClientLoop continuously downloads new keys from the master and applies them.
-func ClientLoop(db *db.Database, leaderAddr string) {
-	c := &client{db: db, leaderAddr: leaderAddr}
+// Stop makes Loop return after the request it is currently waiting for.
+func (c *Client) Stop() {
+	close(c.done)
+}
+
+// SetLeader changes the address of the leader to download the changes from
+// and the config epoch sent to it.
+func (c *Client) SetLeader(addr string, epoch int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leaderAddr = addr
+	c.epoch = epoch
+}
+
+// get sends the request to the leader with the HTTP client and returns
+// the response body if the request has succeeded.
+func (c *Client) get(client *http.Client, path string, u url.Values) (io.ReadCloser, error) {
+	c.mu.Lock()
+	leaderAddr, epoch := c.leaderAddr, c.epoch
+	c.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+leaderAddr+path+"?"+u.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(config.EpochHeader, strconv.FormatInt(epoch, 10))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		result, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %q from leader %q: %s", resp.Status, leaderAddr, result)
+	}
+
+	return resp.Body, nil
+}
+
+// Loop continuously downloads new keys from the master and applies them.
+// If the replica cannot catch up with the leader by replication, e.g. when
+// it was added after the leader removed the first changes from its log,
+// the replica is resynced from the leader snapshot and the replication
+// continues after the snapshot. The replica does not serve reads until then.
+func (c *Client) Loop() {
 	for {
-		present, err := c.loop()
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		err := c.loop()
+		if errors.Is(err, errResyncNeeded) {
+			log.Printf("Resyncing the replica: %v", err)
+			c.setStopped(true)
+			if err = c.resync(); err == nil {
+				c.setStopped(false)
+			}
+		}
 		if err != nil {
 			log.Printf("Loop error: %v", err)
-			time.Sleep(time.Second)
-			continue
+			select {
+			case <-c.done:
+			case <-time.After(time.Second):
+			}
 		}
+	}
+}
 
-		if !present {
-			time.Sleep(time.Millisecond * 100)
-		}
+// Stopped reports whether the replication has stopped because
+// the replica has to be resynced and the resync has not succeeded yet.
+func (c *Client) Stopped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stopped
+}
+
+func (c *Client) setStopped(stopped bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopped = stopped
+}
+
+// Staleness returns how far the replica may lag behind the leader: the time
+// since the replica sent the last request that the leader answered with
+// all of its changes. The replica had every change made before that moment,
+// and the staleness keeps growing while the leader cannot be reached.
+func (c *Client) Staleness() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped || c.caughtUpAt.IsZero() {
+		return time.Duration(math.MaxInt64)
 	}
+	return time.Since(c.caughtUpAt)
 }
 
-func (c *client) loop() (present bool, err error) {
-	resp, err := http.Get("http://" + c.leaderAddr + "/next-replication-key")
+// setCaughtUp records that the replica has applied all changes
+// the leader had when the request was sent at the provided time.
+func (c *Client) setCaughtUp(sent time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sent.After(c.caughtUpAt) {
+		c.caughtUpAt = sent
+	}
+}
+
+// loop downloads and applies the next batch of changes.
+// The leader holds the request open until there are changes to download.
+func (c *Client) loop() error {
+	after, err := c.db.AppliedSeq()
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	var res NextKeyValue
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return false, err
+	u := url.Values{}
+	u.Set("replica", c.name)
+	u.Set("after", strconv.FormatUint(after, 10))
+	u.Set("limit", strconv.Itoa(batchSize))
+	u.Set("max-bytes", strconv.Itoa(batchBytes))
+	u.Set("wait", pollWait.String())
+
+	sent := time.Now()
+	body, err := c.get(httpClient, "/next-replication-keys", u)
+	if err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
 
-	if res.Err != nil {
-		return false, err
+	var res NextKeyValues
+	if err := json.NewDecoder(body).Decode(&res); err != nil {
+		return err
 	}
 
-	if res.Key == "" {
-		return false, nil
+	if res.Truncated {
+		return fmt.Errorf("%w: %s", errResyncNeeded, res.Err)
+	}
+	if res.Err != "" {
+		return fmt.Errorf("next replication keys: %s", res.Err)
 	}
 
-	if err := c.db.SetKeyOnReplica(res.Key, []byte(res.Value)); err != nil {
-		return false, err
+	if len(res.Entries) == 0 {
+		if after >= res.LastSeq {
+			c.setCaughtUp(sent)
+		}
+		return nil
 	}
 
-	if err := c.deleteFromReplicationQueue(res.Key, res.Value); err != nil {
-		log.Printf("DeleteKeyFromReplication failed: %v", err)
+	entries := logEntries(res.Entries)
+	if err := c.db.ApplyLogEntries(entries); err != nil {
+		return err
+	}
+	if entries[len(entries)-1].Seq >= res.LastSeq {
+		c.setCaughtUp(sent)
+	}
+
+	if err := c.ackReplication(entries[len(entries)-1].Seq); err != nil {
+		log.Printf("AckReplication failed: %v", err)
 	}
 
-	return true, nil
+	return nil
 }
 
-func (c *client) deleteFromReplicationQueue(key, value string) error {
+// resync replaces all keys of the replica with the leader snapshot,
+// so that the replication continues after the changes the snapshot includes.
+func (c *Client) resync() error {
 	u := url.Values{}
-	u.Set("key", key)
-	u.Set("value", value)
+	u.Set("replica", c.name)
+
+	sent := time.Now()
+	body, err := c.get(snapshotClient, "/replication-snapshot", u)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var res Snapshot
+	if err := json.NewDecoder(body).Decode(&res); err != nil {
+		return err
+	}
+	if res.Err != "" {
+		return fmt.Errorf("replication snapshot: %s", res.Err)
+	}
+
+	if err := c.db.LoadSnapshot(res.Seq, logEntries(res.Entries)); err != nil {
+		return err
+	}
+	c.setCaughtUp(sent)
 
-	log.Printf("Deleting key=%q, value=%q from replication queue on %q", key, value, c.leaderAddr)
+	if err := c.ackReplication(res.Seq); err != nil {
+		log.Printf("AckReplication failed: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) ackReplication(seq uint64) error {
+	u := url.Values{}
+	u.Set("replica", c.name)
+	u.Set("seq", strconv.FormatUint(seq, 10))
 
-	resp, err := http.Get("http://" + c.leaderAddr + "/delete-replication-key?" + u.Encode())
+	body, err := c.get(httpClient, "/ack-replication", u)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
 
-	result, err := ioutil.ReadAll(resp.Body)
+	result, err := ioutil.ReadAll(body)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,297 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YuriyNasretdinov/distribkv/db"
+)
+
+// batchPath is the prefix of the batch endpoints: /v1/batch/get and /v1/batch/set.
+const batchPath = "/v1/batch/"
+
+const (
+	batchGet = "get"
+	batchSet = "set"
+)
+
+// BatchItem is a key with its value in batch set requests.
+// Binary values are sent base64-encoded in ValueBase64 instead of Value.
+// TTL is the duration after which the key expires, e.g. "30s".
+type BatchItem struct {
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 []byte  `json:"value_base64,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+	TTL         string  `json:"ttl,omitempty"`
+}
+
+func (it *BatchItem) value() []byte {
+	if it.Value != nil {
+		return []byte(*it.Value)
+	}
+	if it.ValueBase64 == nil {
+		return []byte{}
+	}
+	return it.ValueBase64
+}
+
+// BatchRequest is the request body for BatchHandler. Keys are read
+// by /v1/batch/get and Items are written by /v1/batch/set.
+type BatchRequest struct {
+	Keys  []string    `json:"keys,omitempty"`
+	Items []BatchItem `json:"items,omitempty"`
+}
+
+// keys returns the keys of the request in the request order.
+func (b *BatchRequest) keys() []string {
+	if b.Items == nil {
+		return b.Keys
+	}
+
+	keys := make([]string, 0, len(b.Items))
+	for _, it := range b.Items {
+		keys = append(keys, it.Key)
+	}
+	return keys
+}
+
+// BatchResponse contains the results of BatchHandler in the request order.
+// Every result has its own error if the key could not be read or written.
+type BatchResponse struct {
+	Results []Response `json:"results"`
+}
+
+// BatchHandler reads or writes multiple keys at once. The keys are grouped
+// by the shard that owns them, every shard receives a single request in parallel,
+// and the writes to a shard are applied in a single transaction.
+// All keys belong to the namespace from the "ns" parameter.
+func (s *Server) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		s.writeError(w, r, CodeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	op := strings.TrimPrefix(r.URL.Path, batchPath)
+	if op != batchGet && op != batchSet {
+		s.writeError(w, r, CodeNotFound, fmt.Errorf("unknown batch operation %q", op))
+		return
+	}
+
+	body, err := s.readValue(r)
+	if err != nil {
+		s.writeError(w, r, errorCode(err), err)
+		return
+	}
+
+	var req BatchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	r.ParseForm()
+	opts, err := s.readOptions(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	if op == batchGet {
+		req.Items = nil
+	} else {
+		req.Keys = nil
+	}
+
+	for _, it := range req.Items {
+		if _, err := parseTTL(it.TTL); err != nil {
+			s.writeError(w, r, CodeBadRequest, fmt.Errorf("key %q: %w", it.Key, err))
+			return
+		}
+	}
+	keys := req.keys()
+	ns := r.Form.Get("ns")
+
+	shards := s.shards()
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		shard := shards.NamespaceIndex(ns, key)
+		groups[shard] = append(groups[shard], i)
+	}
+
+	results := make([]Response, len(keys))
+
+	var wg sync.WaitGroup
+	for shard, idxs := range groups {
+		wg.Add(1)
+		go func(shard int, idxs []int) {
+			defer wg.Done()
+
+			var part BatchRequest
+			for _, i := range idxs {
+				if op == batchGet {
+					part.Keys = append(part.Keys, keys[i])
+				} else {
+					part.Items = append(part.Items, req.Items[i])
+				}
+			}
+
+			for j, res := range s.batchShard(r, op, shard, opts, &part) {
+				results[idxs[j]] = res
+			}
+		}(shard, idxs)
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, &BatchResponse{Results: results})
+}
+
+// batchShard runs the part of the batch that belongs to the shard
+// locally or on the node that can serve it.
+func (s *Server) batchShard(r *http.Request, op string, shard int, opts readOptions, part *BatchRequest) []Response {
+	shards := s.shards()
+
+	if op == batchGet {
+		if shard == shards.CurIdx && s.canReadLocally(opts) {
+			return s.localBatchGet(r, shard, part.Keys)
+		}
+
+		if shard != shards.CurIdx && opts.consistency != ConsistencyLeader {
+			if addr, ok := s.nextReplica(shard); ok {
+				res, err := s.remoteBatch(r, op, addr, opts, part)
+				if err == nil {
+					return res
+				}
+			}
+		}
+	} else if shard == shards.CurIdx && s.Replication == nil {
+		return s.localBatchSet(r, shard, part.Items)
+	}
+
+	res, err := s.remoteBatch(r, op, shards.Addrs[shard], opts, part)
+	if err == nil {
+		return res
+	}
+
+	code := errorCode(err)
+	if code == CodeInternal {
+		code = CodeProxyFailed
+	}
+
+	keys := part.keys()
+	res = make([]Response, 0, len(keys))
+	for _, key := range keys {
+		kr := s.keyResponse(r, key, shard)
+		kr.Error = &Error{Code: code, Message: fmt.Sprintf("sending the batch to shard %d: %v", shard, err)}
+		res = append(res, *kr)
+	}
+	return res
+}
+
+func (s *Server) localBatchGet(r *http.Request, shard int, keys []string) []Response {
+	ns := namespaceOf(r)
+	values, err := s.db.In(ns).GetKeys(keys)
+
+	res := make([]Response, 0, len(keys))
+	for i, key := range keys {
+		kr := s.keyResponse(r, key, shard)
+
+		var value []byte
+		var meta db.Meta
+		keyErr := err
+		if err == nil {
+			value, meta = values[i].Value, values[i].Meta
+			if value == nil {
+				value, keyErr = s.getMigratingKey(ns, key)
+			}
+			if keyErr == nil && value == nil {
+				keyErr = fmt.Errorf("%w: %q", errNotFound, key)
+			}
+		}
+
+		if keyErr != nil {
+			kr.Error = &Error{Code: errorCode(keyErr), Message: keyErr.Error()}
+		} else {
+			kr.setValue(value, meta)
+		}
+		res = append(res, *kr)
+	}
+	return res
+}
+
+func (s *Server) localBatchSet(r *http.Request, shard int, items []BatchItem) []Response {
+	ns := namespaceOf(r)
+	now := time.Now().UTC()
+
+	keys := make([]string, 0, len(items))
+	kvs := make([]db.KeyValue, 0, len(items))
+	for _, it := range items {
+		meta := db.Meta{ContentType: it.ContentType}
+		if ttl, _ := parseTTL(it.TTL); ttl > 0 {
+			meta.Expires = now.Add(ttl)
+		}
+
+		keys = append(keys, it.Key)
+		kvs = append(kvs, db.KeyValue{Key: it.Key, Value: it.value(), Meta: meta})
+	}
+
+	err := s.migrations.writeKeys(ns, keys, func() error {
+		return s.db.In(ns).SetKeys(kvs)
+	})
+
+	res := make([]Response, 0, len(items))
+	for _, key := range keys {
+		kr := s.keyResponse(r, key, shard)
+		if err != nil {
+			kr.Error = &Error{Code: errorCode(err), Message: err.Error()}
+		}
+		res = append(res, *kr)
+	}
+	return res
+}
+
+// remoteBatch sends the part of the batch to the node at addr.
+// The consistency options are passed explicitly like in redirectRead.
+func (s *Server) remoteBatch(r *http.Request, op string, addr string, opts readOptions, part *BatchRequest) ([]Response, error) {
+	body, err := json.Marshal(part)
+	if err != nil {
+		return nil, err
+	}
+
+	q := r.URL.Query()
+	opts.encode(q)
+
+	req, err := s.newForwardRequest(r, http.MethodPost, "http://"+addr+batchPath+op+"?"+q.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %q from %q: %s", resp.Status, addr, result)
+	}
+
+	var res BatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	if n := len(part.keys()); len(res.Results) != n {
+		return nil, fmt.Errorf("got %d results from %q, want %d", len(res.Results), addr, n)
+	}
+	return res.Results, nil
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/YuriyNasretdinov/distribkv/db"
+)
+
+// formCondition returns the condition of the write from the
+// "if-absent", "if-value" and "if-etag" parameters.
+func formCondition(r *http.Request) (db.Condition, error) {
+	var cond db.Condition
+
+	if a := r.Form.Get("if-absent"); a != "" {
+		var err error
+		if cond.IfAbsent, err = strconv.ParseBool(a); err != nil {
+			return db.Condition{}, fmt.Errorf("parsing if-absent: %w", err)
+		}
+	}
+
+	if v, ok := r.Form["if-value"]; ok {
+		cond.IfValue = []byte(v[0])
+	}
+	cond.IfETag = r.Form.Get("if-etag")
+
+	return cond, nil
+}
+
+// headerCondition returns the condition of the write from the If-Match
+// and If-None-Match headers. Only a single entity tag or "*" is supported.
+func headerCondition(r *http.Request) (db.Condition, error) {
+	var cond db.Condition
+
+	if m := strings.TrimSpace(r.Header.Get("If-Match")); m == "*" {
+		cond.IfExists = true
+	} else if m != "" {
+		etag, err := parseETag(m)
+		if err != nil {
+			return db.Condition{}, fmt.Errorf("parsing If-Match: %w", err)
+		}
+		cond.IfETag = etag
+	}
+
+	if m := strings.TrimSpace(r.Header.Get("If-None-Match")); m == "*" {
+		cond.IfAbsent = true
+	} else if m != "" {
+		return db.Condition{}, errors.New(`only "*" is supported in If-None-Match for writes`)
+	}
+
+	return cond, nil
+}
+
+func parseETag(s string) (string, error) {
+	s = strings.TrimPrefix(s, "W/")
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' || strings.Contains(s[1:len(s)-1], `"`) {
+		return "", fmt.Errorf("invalid entity tag %s", s)
+	}
+	return s[1 : len(s)-1], nil
+}
+
+func formatETag(etag string) string {
+	return `"` + etag + `"`
+}
@@ -0,0 +1,138 @@
+package web
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Consistency is the consistency level of read requests.
+type Consistency string
+
+const (
+	// ConsistencyLeader reads are served only by shard leaders.
+	ConsistencyLeader Consistency = "leader"
+	// ConsistencyAny reads can be served by any replica of the shard.
+	ConsistencyAny Consistency = "any"
+	// ConsistencyBoundedStaleness reads can be served by replicas
+	// that lag behind the leader no more than the allowed staleness.
+	ConsistencyBoundedStaleness Consistency = "bounded-staleness"
+)
+
+// ParseConsistency validates the consistency level name.
+func ParseConsistency(name string) (Consistency, error) {
+	switch c := Consistency(name); c {
+	case ConsistencyLeader, ConsistencyAny, ConsistencyBoundedStaleness:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown consistency level %q", name)
+}
+
+type readOptions struct {
+	consistency  Consistency
+	maxStaleness time.Duration
+}
+
+// readOptions returns the consistency options from the "consistency" and
+// "max-staleness" parameters or the server defaults.
+func (s *Server) readOptions(r *http.Request) (readOptions, error) {
+	opts := readOptions{
+		consistency:  s.DefaultConsistency,
+		maxStaleness: s.MaxStaleness,
+	}
+
+	if opts.consistency == "" {
+		opts.consistency = ConsistencyLeader
+	}
+
+	if c := r.Form.Get("consistency"); c != "" {
+		var err error
+		if opts.consistency, err = ParseConsistency(c); err != nil {
+			return readOptions{}, err
+		}
+	}
+
+	if m := r.Form.Get("max-staleness"); m != "" {
+		var err error
+		if opts.maxStaleness, err = time.ParseDuration(m); err != nil {
+			return readOptions{}, fmt.Errorf("parsing max-staleness: %w", err)
+		}
+	}
+
+	return opts, nil
+}
+
+// encode sets the parameters parsed by readOptions.
+func (o readOptions) encode(q url.Values) {
+	q.Set("consistency", string(o.consistency))
+	if o.consistency == ConsistencyBoundedStaleness {
+		q.Set("max-staleness", o.maxStaleness.String())
+	}
+}
+
+// canReadLocally reports whether the current node can serve the read of
+// a key from the current shard.
+func (s *Server) canReadLocally(opts readOptions) bool {
+	if s.Replication == nil {
+		return true
+	}
+	// The replica that stopped replicating misses some changes until it is resynced.
+	if s.Replication.Stopped() {
+		return false
+	}
+
+	switch opts.consistency {
+	case ConsistencyAny:
+		return true
+	case ConsistencyBoundedStaleness:
+		return s.Replication.Staleness() <= opts.maxStaleness
+	}
+	return false
+}
+
+// nextReplica returns the address of the shard replica to read from.
+func (s *Server) nextReplica(shard int) (addr string, ok bool) {
+	replicas := s.shards().Replicas[shard]
+	if len(replicas) == 0 {
+		return "", false
+	}
+
+	n := atomic.AddUint64(&s.readCounter, 1)
+	return replicas[n%uint64(len(replicas))], true
+}
+
+// redirectRead sends the read request to one of the replicas of the shard
+// if the consistency level allows it or to the shard leader otherwise.
+// The consistency options are passed explicitly so that the receiving node
+// does not apply its own defaults.
+func (s *Server) redirectRead(shard int, opts readOptions, w http.ResponseWriter, r *http.Request) {
+	routing, err := s.routing(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	q := r.URL.Query()
+	opts.encode(q)
+	r.URL.RawQuery = q.Encode()
+
+	if shard != s.shards().CurIdx && opts.consistency != ConsistencyLeader {
+		if addr, ok := s.nextReplica(shard); ok {
+			if routing == RoutingRedirect {
+				s.moved(shard, addr, w, r)
+				return
+			}
+
+			err := s.proxy(addr, w, r)
+			if err == nil {
+				return
+			}
+			log.Printf("Reading from replica %q failed, falling back to the leader: %v", addr, err)
+		}
+	}
+
+	s.redirect(shard, w, r)
+}
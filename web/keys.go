@@ -0,0 +1,153 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/YuriyNasretdinov/distribkv/db"
+)
+
+// keysPath is the prefix of the key resource: /v1/keys/{key}.
+const keysPath = "/v1/keys/"
+
+// KeysHandler serves the key resource at /v1/keys/{key}.
+// GET returns the raw value, PUT sets the value to the request body
+// and DELETE deletes the key. Requests are routed to the shard that owns the key.
+// JSON responses are returned instead of raw values when requested.
+// GET returns the value with the content type it was stored with and its
+// version in the ETag, and the writes can be made conditional with the
+// If-Match and If-None-Match headers. PUT makes the key expire after
+// the duration from the "ttl" query parameter. The key is looked up in
+// the namespace from the "ns" query parameter, the default one if it is empty.
+func (s *Server) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, keysPath)
+	if key == "" {
+		s.writeError(w, r, CodeBadRequest, errors.New("key must not be empty"))
+		return
+	}
+
+	ns := r.URL.Query().Get("ns")
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getKey(ns, key, w, r)
+	case http.MethodPut, http.MethodDelete:
+		s.changeKey(ns, key, w, r)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		s.writeError(w, r, CodeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+func (s *Server) getKey(ns, key string, w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+
+	r.ParseForm()
+	opts, err := s.readOptions(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	shard := shards.NamespaceIndex(ns, key)
+	if shard != shards.CurIdx || !s.canReadLocally(opts) {
+		s.redirectRead(shard, opts, w, r)
+		return
+	}
+
+	value, meta, err := s.readKey(ns, key)
+	if err == nil && value == nil {
+		err = fmt.Errorf("%w: %q", errNotFound, key)
+	}
+
+	if wantJSON(r) {
+		res := s.keyResponse(r, key, shard)
+		if value != nil {
+			res.setValue(value, meta)
+		}
+		writeResult(w, res, err)
+		return
+	} else if err != nil {
+		s.writeError(w, r, errorCode(err), err)
+		return
+	}
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	setMetaHeaders(w, meta)
+	w.Write(value)
+}
+
+func (s *Server) changeKey(ns, key string, w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+
+	// Replicas send the writes for their own shard to the leader.
+	shard := shards.NamespaceIndex(ns, key)
+	if shard != shards.CurIdx || s.Replication != nil {
+		s.redirect(shard, w, r)
+		return
+	}
+
+	cond, err := headerCondition(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	var meta db.Meta
+	if r.Method == http.MethodPut {
+		var ttl time.Duration
+		if ttl, err = parseTTL(r.URL.Query().Get("ttl")); err != nil {
+			s.writeError(w, r, CodeBadRequest, err)
+			return
+		}
+
+		var value []byte
+		if value, err = s.readValue(r); err != nil {
+			s.writeError(w, r, errorCode(err), err)
+			return
+		}
+
+		opts := db.SetOptions{Condition: cond, ContentType: r.Header.Get("Content-Type"), TTL: ttl}
+		err = s.writeKey(ns, key, cond, func() (err error) {
+			meta, err = s.db.In(ns).SetKeyWith(key, value, opts)
+			return err
+		})
+	} else {
+		err = s.writeKey(ns, key, cond, func() error { return s.db.In(ns).DeleteKeyIf(key, cond) })
+	}
+
+	if wantJSON(r) {
+		res := s.keyResponse(r, key, shard)
+		if err == nil && r.Method == http.MethodPut {
+			res.setMeta(meta)
+		}
+		writeResult(w, res, err)
+		return
+	} else if err != nil {
+		s.writeError(w, r, errorCode(err), err)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		setMetaHeaders(w, meta)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setMetaHeaders sets the ETag, Last-Modified and Expires headers from the key metadata.
+func setMetaHeaders(w http.ResponseWriter, meta db.Meta) {
+	w.Header().Set("ETag", formatETag(meta.ETag()))
+	if !meta.Modified.IsZero() {
+		w.Header().Set("Last-Modified", meta.Modified.Format(http.TimeFormat))
+	}
+	if !meta.Expires.IsZero() {
+		w.Header().Set("Expires", meta.Expires.Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,152 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/YuriyNasretdinov/distribkv/db"
+)
+
+// namespacesPath is the path of the namespace list, and the namespaces
+// themselves are at /v1/namespaces/{name}.
+const namespacesPath = "/v1/namespaces"
+
+// NamespacesResponse is the response with the list of namespaces.
+// The default namespace is not listed.
+type NamespacesResponse struct {
+	Namespaces []string `json:"namespaces"`
+	Node       string   `json:"node"`
+}
+
+// namespaceOf returns the namespace of the request from the "ns" parameter.
+// The empty namespace is the default one.
+func namespaceOf(r *http.Request) string {
+	if r.Form != nil {
+		return r.Form.Get("ns")
+	}
+	return r.URL.Query().Get("ns")
+}
+
+// NamespacesHandler manages the namespaces. GET /v1/namespaces lists them,
+// PUT /v1/namespaces/{name} creates the namespace and DELETE deletes it
+// together with all its keys. The changes are applied on the leaders of all
+// shards, or only on the leader of the current shard with the "local" scope.
+func (s *Server) NamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, namespacesPath), "/")
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			s.writeError(w, r, CodeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+
+		names, err := s.db.Namespaces()
+		if err != nil {
+			s.writeError(w, r, errorCode(err), err)
+			return
+		}
+		if names == nil {
+			names = []string{}
+		}
+		writeJSON(w, http.StatusOK, &NamespacesResponse{Namespaces: names, Node: s.node()})
+		return
+	}
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PUT, DELETE")
+		s.writeError(w, r, CodeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	if err := db.ValidateNamespace(name); err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	r.ParseForm()
+
+	var err error
+	switch scope := r.Form.Get("scope"); scope {
+	case "", ScopeCluster:
+		err = s.changeNamespaceCluster(r, name)
+	case ScopeLocal:
+		if s.Replication != nil {
+			s.redirect(s.shards().CurIdx, w, r)
+			return
+		}
+		err = s.changeNamespace(r.Method, name)
+	default:
+		s.writeError(w, r, CodeBadRequest, fmt.Errorf("unknown scope %q", scope))
+		return
+	}
+
+	if err != nil {
+		s.writeError(w, r, errorCode(err), err)
+		return
+	}
+	s.writeOK(w, r)
+}
+
+func (s *Server) changeNamespace(method, name string) error {
+	if method == http.MethodPut {
+		return s.db.CreateNamespace(name)
+	}
+	return s.db.DeleteNamespace(name)
+}
+
+// changeNamespaceCluster creates or deletes the namespace on every shard in parallel.
+// The replicas receive the change from their leaders.
+func (s *Server) changeNamespaceCluster(r *http.Request, name string) error {
+	shards := s.shards()
+
+	errs := make([]error, shards.Count)
+
+	var wg sync.WaitGroup
+	for shard := 0; shard < shards.Count; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+
+			if shard == shards.CurIdx && s.Replication == nil {
+				errs[shard] = s.changeNamespace(r.Method, name)
+			} else {
+				errs[shard] = s.remoteNamespace(r, shards.Addrs[shard], name)
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	for shard, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", shard, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) remoteNamespace(r *http.Request, addr, name string) error {
+	req, err := s.newForwardRequest(r, r.Method, "http://"+addr+namespacesPath+"/"+name+"?scope="+ScopeLocal, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %q from %q: %s", resp.Status, addr, result)
+	}
+	return nil
+}
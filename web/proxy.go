@@ -0,0 +1,214 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// hopsHeader is the HTTP header with the number of times
+	// the request has been proxied between the nodes.
+	hopsHeader = "X-Distribkv-Hops"
+	// maxHops is the number of proxy hops after which the request
+	// is considered to be in a routing loop.
+	maxHops = 4
+
+	proxyTimeout = 30 * time.Second
+)
+
+var errRoutingLoop = errors.New("routing loop detected")
+
+// Routing is the way the requests for the keys from other shards are served.
+type Routing string
+
+const (
+	// RoutingProxy requests are forwarded to the owner by the receiving node.
+	RoutingProxy Routing = "proxy"
+	// RoutingRedirect requests are answered with 307 Temporary Redirect
+	// to the owner, so that the clients can send them there directly.
+	RoutingRedirect Routing = "redirect"
+)
+
+// ParseRouting validates the routing mode name.
+func ParseRouting(name string) (Routing, error) {
+	switch r := Routing(name); r {
+	case RoutingProxy, RoutingRedirect:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown routing mode %q", name)
+}
+
+// routing returns the routing mode from the "routing" parameter
+// or the server default.
+func (s *Server) routing(r *http.Request) (Routing, error) {
+	if name := r.URL.Query().Get("routing"); name != "" {
+		return ParseRouting(name)
+	}
+
+	if s.DefaultRouting == "" {
+		return RoutingProxy, nil
+	}
+	return s.DefaultRouting, nil
+}
+
+// httpClient is shared by all requests to the other nodes
+// so that the connections to them are reused.
+var httpClient = &http.Client{
+	Timeout: proxyTimeout,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          1000,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: proxyTimeout,
+	},
+	// Redirects are passed to the client as is.
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// hopHeaders are the headers that only apply to a single connection
+// and are not forwarded by the proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		dst.Del(k)
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+
+	for _, h := range hopHeaders {
+		dst.Del(h)
+	}
+}
+
+// redirect sends the request to the leader of the shard.
+func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
+	s.forward(shard, s.shards().Addrs[shard], w, r)
+}
+
+// forward proxies the request to the node of the shard at addr
+// or redirects the client there depending on the routing mode.
+func (s *Server) forward(shard int, addr string, w http.ResponseWriter, r *http.Request) {
+	routing, err := s.routing(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	if routing == RoutingRedirect {
+		s.moved(shard, addr, w, r)
+		return
+	}
+
+	if err := s.proxy(addr, w, r); err != nil {
+		code := errorCode(err)
+		if code == CodeInternal {
+			code = CodeProxyFailed
+		}
+		s.writeError(w, r, code, fmt.Errorf("redirecting the request to shard %d: %w", shard, err))
+	}
+}
+
+// newForwardRequest creates a request to another node on behalf of the
+// client request r. The number of hops is counted in the hopsHeader, and
+// the request is rejected once it reaches maxHops. The receiving node
+// reports the request as proxied in JSON responses.
+func (s *Server) newForwardRequest(r *http.Request, method, url string, body io.Reader) (*http.Request, error) {
+	hops, _ := strconv.Atoi(r.Header.Get(hopsHeader))
+	if hops >= maxHops {
+		return nil, fmt.Errorf("%w: the request has been proxied %d times", errRoutingLoop, hops)
+	}
+
+	req, err := s.newRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(r.Context())
+	req.Header.Set(hopsHeader, strconv.Itoa(hops+1))
+	req.Header.Set(proxiedHeader, s.node())
+	return req, nil
+}
+
+// proxy forwards the request to the node at addr preserving the method,
+// body and headers, and copies the response back to the client.
+// Nothing is written to w if the request could not be sent.
+func (s *Server) proxy(addr string, w http.ResponseWriter, r *http.Request) error {
+	// The form values have already been read from the body by ParseForm.
+	// SetHandler keeps a raw value in the body and leaves PostForm unset.
+	body := r.Body
+	if r.PostForm != nil && isFormBody(r) {
+		body = ioutil.NopCloser(strings.NewReader(r.PostForm.Encode()))
+	}
+
+	req, err := s.newForwardRequest(r, r.Method, "http://"+addr+r.URL.RequestURI(), body)
+	if err != nil {
+		return err
+	}
+
+	// The headers of the forwarded request take precedence over the client ones.
+	own := req.Header
+	req.Header = make(http.Header)
+	copyHeader(req.Header, r.Header)
+	copyHeader(req.Header, own)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		req.Header.Set("X-Forwarded-For", host)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return nil
+}
+
+// moved replies with 307 Temporary Redirect to the same request at the
+// node of the shard at addr. JSON responses also contain the owner shard and address.
+func (s *Server) moved(shard int, addr string, w http.ResponseWriter, r *http.Request) {
+	location := "http://" + addr + r.URL.RequestURI()
+	w.Header().Set("Location", location)
+
+	if !wantJSON(r) {
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+		return
+	}
+
+	res := s.newResponse(r)
+	res.Shard = &shard
+	res.Owner = addr
+	res.Error = &Error{Code: CodeMoved, Message: fmt.Sprintf("the request must be sent to shard %d at %q", shard, addr)}
+	writeJSON(w, codeStatus[CodeMoved], res)
+}
@@ -0,0 +1,465 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/YuriyNasretdinov/distribkv/config"
+	"github.com/YuriyNasretdinov/distribkv/db"
+)
+
+// migrationBatchSize is the number of keys sent to the new owner at once.
+const migrationBatchSize = 1000
+
+// MigrationBatch is the request body for MigrateKeysHandler.
+// Namespace is the namespace of the keys.
+type MigrationBatch struct {
+	Namespace string
+	Keys      []db.KeyValue
+}
+
+// migrations tracks the shards that move their keys to the current shard.
+// While the keys are moved, the current shard reads the missing keys from
+// the previous owners, and the keys changed locally, including the deleted
+// ones, are not overwritten by the migrated values.
+// The previous owner of a key is found with the previous config. The sources
+// that are not in the previous config, e.g. when the migration was started
+// by the first batch of keys, may have any key.
+// The written keys are prefixed with their namespace.
+type migrations struct {
+	mu        sync.Mutex
+	prev      *config.Shards
+	prevAddrs map[string]bool
+	sources   map[string]bool
+	written   map[string]bool
+}
+
+func writtenKey(ns, key string) string {
+	return ns + "\x00" + key
+}
+
+// write runs fn that changes the key in the namespace.
+func (m *migrations) write(ns, key string, fn func() error) error {
+	return m.writeKeys(ns, []string{key}, fn)
+}
+
+// writeKeys runs fn that changes the keys in the namespace.
+// The keys are not marked as written if fn fails.
+func (m *migrations) writeKeys(ns string, keys []string, fn func() error) error {
+	m.mu.Lock()
+	if len(m.sources) == 0 {
+		m.mu.Unlock()
+		return fn()
+	}
+	defer m.mu.Unlock()
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		m.written[writtenKey(ns, key)] = true
+	}
+	return nil
+}
+
+func (m *migrations) init() {
+	if m.sources == nil {
+		m.sources = make(map[string]bool)
+		m.written = make(map[string]bool)
+	}
+}
+
+// start records that the keys are moved from their owners in the previous
+// config to the current shard with the address self.
+func (m *migrations) start(prev *config.Shards, self string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	m.prev = prev
+	m.prevAddrs = make(map[string]bool)
+	for _, addr := range prev.Addrs {
+		m.prevAddrs[addr] = true
+		if addr != self {
+			m.sources[addr] = true
+		}
+	}
+}
+
+// apply stores the keys received from the source in the namespace of d
+// unless they have been changed locally since the migration has started.
+func (m *migrations) apply(d db.Store, source string, kvs []db.KeyValue) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	m.sources[source] = true
+
+	res := make([]db.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		if !m.written[writtenKey(d.Namespace(), kv.Key)] {
+			res = append(res, kv)
+		}
+	}
+
+	return d.SetKeysIfAbsent(res)
+}
+
+func (m *migrations) finish(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sources, source)
+	if len(m.sources) == 0 {
+		m.prev = nil
+		m.prevAddrs = nil
+		m.written = make(map[string]bool)
+	}
+}
+
+// sourcesFor returns the previous owners that may still have the key in the namespace.
+func (m *migrations) sourcesFor(ns, key string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.written[writtenKey(ns, key)] {
+		return nil
+	}
+
+	var owner string
+	if m.prev != nil {
+		owner = m.prev.Addrs[m.prev.NamespaceIndex(ns, key)]
+	}
+
+	var res []string
+	for s := range m.sources {
+		if s == owner || !m.prevAddrs[s] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// readKey reads the key with its metadata, or from the previous owners
+// if the key has not been moved to the current shard yet.
+// The keys read from the previous owners have no metadata.
+func (s *Server) readKey(ns, key string) ([]byte, db.Meta, error) {
+	value, meta, err := s.db.In(ns).GetKeyMeta(key)
+	if err == nil && value == nil {
+		value, err = s.getMigratingKey(ns, key)
+	}
+	return value, meta, err
+}
+
+// getMigratingKey reads the key that is absent locally from the shards
+// that are moving their keys to the current shard.
+func (s *Server) getMigratingKey(ns, key string) ([]byte, error) {
+	for _, source := range s.migrations.sourcesFor(ns, key) {
+		q := url.Values{"key": {key}, "ns": {ns}}
+		req, err := s.newRequest(http.MethodGet, "http://"+source+"/local-get?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return value, nil
+		case http.StatusNotFound:
+			continue
+		default:
+			return nil, fmt.Errorf("reading from %q: %s", source, value)
+		}
+	}
+
+	return nil, nil
+}
+
+// writeKey runs fn that changes the key. Conditional writes are run
+// by updateKey, so that the condition is checked against the current value.
+func (s *Server) writeKey(ns, key string, cond db.Condition, fn func() error) error {
+	if cond.IsZero() {
+		return s.migrations.write(ns, key, fn)
+	}
+	return s.updateKey(ns, key, fn)
+}
+
+// updateKey runs fn that changes the key based on its current value.
+// The key that has not been moved from its previous owner yet is copied first.
+func (s *Server) updateKey(ns, key string, fn func() error) error {
+	if len(s.migrations.sourcesFor(ns, key)) > 0 {
+		local, err := s.db.In(ns).GetKey(key)
+		if err != nil {
+			return err
+		}
+
+		if local == nil {
+			value, err := s.getMigratingKey(ns, key)
+			if err != nil {
+				return err
+			}
+
+			if value != nil {
+				err = s.migrations.write(ns, key, func() error {
+					return s.db.In(ns).SetKeysIfAbsent([]db.KeyValue{{Key: key, Value: value}})
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return s.migrations.write(ns, key, fn)
+}
+
+// LocalGetHandler returns the raw value of the key stored on the current node
+// regardless of the shard that owns the key, or 404 if the key is absent.
+// The key is looked up in the namespace from the "ns" parameter.
+func (s *Server) LocalGetHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	key := r.Form.Get("key")
+	ns := r.Form.Get("ns")
+
+	value, meta, err := s.db.In(ns).GetKeyMeta(key)
+	if err == nil && value == nil {
+		err = fmt.Errorf("%w: %q", errNotFound, key)
+	}
+
+	if wantJSON(r) {
+		res := s.keyResponse(r, key, s.shards().NamespaceIndex(ns, key))
+		if err == nil {
+			res.setValue(value, meta)
+		}
+		writeResult(w, res, err)
+		return
+	}
+
+	if err != nil {
+		s.writeError(w, r, errorCode(err), err)
+		return
+	}
+	w.Write(value)
+}
+
+// MigrateKeysHandler stores the keys sent by the previous owner
+// from the "source" parameter. The keys that already exist are not overwritten.
+func (s *Server) MigrateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		s.writeError(w, r, CodeBadRequest, errors.New("source must be provided"))
+		return
+	}
+
+	var batch MigrationBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	for _, kv := range batch.Keys {
+		if shard := shards.NamespaceIndex(batch.Namespace, kv.Key); shard != shards.CurIdx {
+			s.writeError(w, r, CodeBadRequest, fmt.Errorf("key %q belongs to shard %d, current shard is %d", kv.Key, shard, shards.CurIdx))
+			return
+		}
+	}
+
+	if err := s.migrations.apply(s.db.In(batch.Namespace), source, batch.Keys); err != nil {
+		s.writeError(w, r, errorCode(err), err)
+		return
+	}
+
+	s.writeOK(w, r)
+}
+
+// FinishMigrationHandler records that the previous owner from the
+// "source" parameter has moved all its keys to the current shard.
+func (s *Server) FinishMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	s.migrations.finish(r.Form.Get("source"))
+	s.writeOK(w, r)
+}
+
+// ReshardHandler moves the keys that do not belong to the current shard
+// to their new owners. The keys are deleted locally only after the new owner
+// has confirmed that it has stored them. Every other shard is told that
+// the migration from the current shard is finished, even if it got no keys.
+func (s *Server) ReshardHandler(w http.ResponseWriter, r *http.Request) {
+	moved, err := s.reshard()
+
+	if wantJSON(r) {
+		res := &ReshardResponse{Node: s.node(), Moved: moved}
+		status := http.StatusOK
+		if err != nil {
+			code := errorCode(err)
+			res.Error = &Error{Code: code, Message: err.Error()}
+			status = codeStatus[code]
+		}
+		writeJSON(w, status, res)
+		return
+	}
+	fmt.Fprintf(w, "Error = %v, moved keys = %d", err, moved)
+}
+
+// namespaces returns the names of all namespaces including the default one.
+func (s *Server) namespaces() ([]string, error) {
+	names, err := s.db.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{""}, names...), nil
+}
+
+func (s *Server) reshard() (moved int, err error) {
+	shards := s.shards()
+
+	names, err := s.namespaces()
+	if err != nil {
+		return 0, err
+	}
+
+	// The keys to move to every shard by their namespace.
+	byShard := make(map[int]map[string][]string)
+	count := make(map[int]int)
+
+	for _, ns := range names {
+		keys, err := s.db.In(ns).ExtraKeys(func(key string) bool {
+			return shards.NamespaceIndex(ns, key) != shards.CurIdx
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		for _, k := range keys {
+			idx := shards.NamespaceIndex(ns, k)
+			if byShard[idx] == nil {
+				byShard[idx] = make(map[string][]string)
+			}
+			byShard[idx][ns] = append(byShard[idx][ns], k)
+			count[idx]++
+		}
+	}
+
+	for shard := 0; shard < shards.Count; shard++ {
+		if shard == shards.CurIdx {
+			continue
+		}
+		if count[shard] > 0 {
+			log.Printf("Moving %d keys to shard %d", count[shard], shard)
+		}
+
+		n, err := s.migrateKeys(shard, byShard[shard])
+		moved += n
+		if err != nil {
+			return moved, fmt.Errorf("moving keys to shard %d: %w", shard, err)
+		}
+	}
+
+	return moved, nil
+}
+
+// migrateKeys moves the keys of every namespace to the shard and
+// then tells the new owner that the migration is finished.
+func (s *Server) migrateKeys(shard int, byNamespace map[string][]string) (moved int, err error) {
+	shards := s.shards()
+
+	addr := shards.Addrs[shard]
+	source := url.QueryEscape(shards.Addrs[shards.CurIdx])
+
+	for ns, keys := range byNamespace {
+		n, err := s.migrateNamespace(addr, source, ns, keys)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	return moved, s.postMigration("http://"+addr+"/finish-migration?source="+source, nil)
+}
+
+func (s *Server) migrateNamespace(addr, source, ns string, keys []string) (moved int, err error) {
+	d := s.db.In(ns)
+
+	for len(keys) > 0 {
+		n := migrationBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+
+		values, err := d.GetKeys(batch)
+		if err != nil {
+			return moved, err
+		}
+
+		var kvs []db.KeyValue
+		for _, kv := range values {
+			if kv.Value != nil {
+				kvs = append(kvs, kv)
+			}
+		}
+
+		body, err := json.Marshal(&MigrationBatch{Namespace: ns, Keys: kvs})
+		if err != nil {
+			return moved, err
+		}
+
+		if err := s.postMigration("http://"+addr+"/migrate-keys?source="+source, body); err != nil {
+			return moved, err
+		}
+
+		// The new owner has the keys now.
+		if err := d.DeleteKeys(batch); err != nil {
+			return moved, err
+		}
+		moved += len(kvs)
+	}
+
+	return moved, nil
+}
+
+func (s *Server) postMigration(url string, body []byte) error {
+	req, err := s.newRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(result, []byte("ok")) {
+		return fmt.Errorf("unexpected response from %q: %s", url, result)
+	}
+
+	return nil
+}
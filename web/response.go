@@ -0,0 +1,240 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/YuriyNasretdinov/distribkv/db"
+)
+
+// proxiedHeader is the HTTP header with the address of the node
+// that has proxied the request to the current one.
+const proxiedHeader = "X-Distribkv-Proxied-By"
+
+var (
+	errNotFound = errors.New("key not found")
+	errTooLarge = errors.New("value is too large")
+)
+
+// ErrorCode is the type of the error in JSON responses.
+type ErrorCode string
+
+// Error codes reported in JSON responses.
+const (
+	CodeBadRequest       ErrorCode = "bad_request"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeNoNamespace      ErrorCode = "namespace_not_found"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeReadOnly         ErrorCode = "read_only"
+	CodeTooLarge         ErrorCode = "too_large"
+	CodeEpochMismatch    ErrorCode = "epoch_mismatch"
+	CodeProxyFailed      ErrorCode = "proxy_failed"
+	CodeLoopDetected     ErrorCode = "loop_detected"
+	CodeMoved            ErrorCode = "moved"
+	CodeConditionFailed  ErrorCode = "condition_failed"
+	CodeNotInteger       ErrorCode = "not_integer"
+	CodeOverflow         ErrorCode = "overflow"
+	CodeInternal         ErrorCode = "internal"
+)
+
+var codeStatus = map[ErrorCode]int{
+	CodeBadRequest:       http.StatusBadRequest,
+	CodeNotFound:         http.StatusNotFound,
+	CodeNoNamespace:      http.StatusNotFound,
+	CodeMethodNotAllowed: http.StatusMethodNotAllowed,
+	CodeReadOnly:         http.StatusForbidden,
+	CodeTooLarge:         http.StatusRequestEntityTooLarge,
+	CodeEpochMismatch:    http.StatusConflict,
+	CodeProxyFailed:      http.StatusBadGateway,
+	CodeLoopDetected:     http.StatusLoopDetected,
+	CodeMoved:            http.StatusTemporaryRedirect,
+	CodeConditionFailed:  http.StatusPreconditionFailed,
+	CodeNotInteger:       http.StatusConflict,
+	CodeOverflow:         http.StatusConflict,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+// Error describes the failure in JSON responses.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// Response is the JSON response of the HTTP handlers.
+// Value is set for the values that are valid UTF-8 and ValueBase64 for other values.
+// Owner is the address of the node to send the request to when it has been redirected.
+type Response struct {
+	Namespace   string     `json:"ns,omitempty"`
+	Key         string     `json:"key,omitempty"`
+	Value       *string    `json:"value,omitempty"`
+	ValueBase64 string     `json:"value_base64,omitempty"`
+	ETag        string     `json:"etag,omitempty"`
+	Version     uint64     `json:"version,omitempty"`
+	Modified    *time.Time `json:"modified,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Shard       *int       `json:"shard,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Node        string     `json:"node"`
+	Proxied     bool       `json:"proxied"`
+	Error       *Error     `json:"error,omitempty"`
+}
+
+// ReshardResponse is the JSON response of ReshardHandler.
+type ReshardResponse struct {
+	Node  string `json:"node"`
+	Moved int    `json:"moved"`
+	Error *Error `json:"error,omitempty"`
+}
+
+// StatusResponse is the JSON response of StatusHandler.
+type StatusResponse struct {
+	Node       string `json:"node"`
+	Epoch      int64  `json:"epoch"`
+	Shard      int    `json:"shard"`
+	ShardCount int    `json:"shard_count"`
+	Replica    bool   `json:"replica"`
+	// ReplicationStopped is set on a replica that is waiting to be resynced
+	// from the leader snapshot and does not serve reads.
+	ReplicationStopped bool `json:"replication_stopped,omitempty"`
+}
+
+// wantJSON reports whether the client has asked for a JSON response
+// with the "format=json" parameter or the Accept header.
+func wantJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// node returns the address of the current node.
+func (s *Server) node() string {
+	if s.Addr != "" {
+		return s.Addr
+	}
+
+	shards := s.shards()
+	return shards.Addrs[shards.CurIdx]
+}
+
+func (s *Server) newResponse(r *http.Request) *Response {
+	return &Response{
+		Node:    s.node(),
+		Proxied: r.Header.Get(proxiedHeader) != "",
+	}
+}
+
+func (s *Server) keyResponse(r *http.Request, key string, shard int) *Response {
+	res := s.newResponse(r)
+	res.Namespace = namespaceOf(r)
+	res.Key = key
+	res.Shard = &shard
+	return res
+}
+
+// setMeta sets the metadata of the key.
+func (res *Response) setMeta(meta db.Meta) {
+	res.ETag = meta.ETag()
+	res.Version = meta.Version
+	res.ContentType = meta.ContentType
+	if !meta.Modified.IsZero() {
+		res.Modified = &meta.Modified
+	}
+	if !meta.Expires.IsZero() {
+		res.Expires = &meta.Expires
+	}
+}
+
+// setValue sets the value of the key together with its metadata.
+func (res *Response) setValue(value []byte, meta db.Meta) {
+	res.setMeta(meta)
+
+	if utf8.Valid(value) {
+		v := string(value)
+		res.Value = &v
+	} else {
+		res.ValueBase64 = base64.StdEncoding.EncodeToString(value)
+	}
+}
+
+func errorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, db.ErrReadOnly):
+		return CodeReadOnly
+	case errors.Is(err, errNotFound):
+		return CodeNotFound
+	case errors.Is(err, db.ErrNoNamespace):
+		return CodeNoNamespace
+	case errors.Is(err, db.ErrInvalidNamespace):
+		return CodeBadRequest
+	case errors.Is(err, errTooLarge):
+		return CodeTooLarge
+	case errors.Is(err, db.ErrConditionFailed):
+		return CodeConditionFailed
+	case errors.Is(err, db.ErrNotInteger):
+		return CodeNotInteger
+	case errors.Is(err, db.ErrOverflow):
+		return CodeOverflow
+	case errors.Is(err, errRoutingLoop):
+		return CodeLoopDetected
+	}
+	return CodeInternal
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeResult writes the JSON response with the result of the operation.
+func writeResult(w http.ResponseWriter, res *Response, err error) {
+	if err == nil {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	code := errorCode(err)
+	res.Error = &Error{Code: code, Message: err.Error()}
+	writeJSON(w, codeStatus[code], res)
+}
+
+// writeError writes the error in the format requested by the client.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, code ErrorCode, err error) {
+	if wantJSON(r) {
+		res := s.newResponse(r)
+		res.Error = &Error{Code: code, Message: err.Error()}
+		writeJSON(w, codeStatus[code], res)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(codeStatus[code])
+	fmt.Fprintf(w, "error: %v", err)
+}
+
+// writeOK reports the success in the format requested by the client.
+func (s *Server) writeOK(w http.ResponseWriter, r *http.Request) {
+	if wantJSON(r) {
+		writeJSON(w, http.StatusOK, s.newResponse(r))
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
+
+// WriteResult reports the success or the error of the handlers that are
+// registered outside of the package in the format requested by the client.
+func (s *Server) WriteResult(w http.ResponseWriter, r *http.Request, err error) {
+	if err != nil {
+		s.writeError(w, r, errorCode(err), err)
+		return
+	}
+	s.writeOK(w, r)
+}
@@ -0,0 +1,292 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// scanPath is the path of ScanHandler.
+const scanPath = "/v1/scan"
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+const (
+	// ScopeCluster scans merge the keys from all shards.
+	ScopeCluster = "cluster"
+	// ScopeLocal scans return only the keys stored on the receiving node.
+	ScopeLocal = "local"
+)
+
+// ScanResponse is the response of ScanHandler. Next is the paging token
+// to pass in the "token" parameter to get the next page.
+// It is empty when there are no more keys.
+type ScanResponse struct {
+	Results []Response `json:"results"`
+	Next    string     `json:"next,omitempty"`
+}
+
+type scanOptions struct {
+	ns     string
+	prefix string
+	start  string
+	end    string
+	limit  int
+}
+
+// encode sets the parameters parsed by scanOptions.
+func (o scanOptions) encode(q url.Values) {
+	q.Set("ns", o.ns)
+	q.Set("prefix", o.prefix)
+	q.Set("start", o.start)
+	q.Set("end", o.end)
+	q.Set("limit", strconv.Itoa(o.limit))
+	q.Del("token")
+}
+
+func encodeToken(next string) string {
+	if next == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(next))
+}
+
+// scanOptionsFrom returns the namespace from the "ns" parameter and the scan
+// range from the "prefix", "start", "end" and "limit" parameters.
+// The "token" from the previous page replaces the start.
+func scanOptionsFrom(r *http.Request) (scanOptions, error) {
+	opts := scanOptions{
+		ns:     r.Form.Get("ns"),
+		prefix: r.Form.Get("prefix"),
+		start:  r.Form.Get("start"),
+		end:    r.Form.Get("end"),
+		limit:  defaultScanLimit,
+	}
+
+	if l := r.Form.Get("limit"); l != "" {
+		var err error
+		if opts.limit, err = strconv.Atoi(l); err != nil {
+			return scanOptions{}, fmt.Errorf("parsing limit: %w", err)
+		}
+		if opts.limit <= 0 || opts.limit > maxScanLimit {
+			return scanOptions{}, fmt.Errorf("limit must be between 1 and %d", maxScanLimit)
+		}
+	}
+
+	if t := r.Form.Get("token"); t != "" {
+		start, err := base64.RawURLEncoding.DecodeString(t)
+		if err != nil {
+			return scanOptions{}, fmt.Errorf("invalid token: %w", err)
+		}
+		opts.start = string(start)
+	}
+
+	return opts, nil
+}
+
+// ScanHandler returns the keys of the namespace from the "ns" parameter
+// with the "prefix" parameter from the ["start", "end") range in the key
+// order, up to "limit" keys at once.
+// With the default "cluster" scope the scan is sent to every shard,
+// and the results are merged. The "local" scope scans only the current node,
+// or the shard leader if the node is a replica that cannot serve the read
+// with the requested consistency.
+func (s *Server) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	opts, err := scanOptionsFrom(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	readOpts, err := s.readOptions(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	var res *ScanResponse
+	switch scope := r.Form.Get("scope"); scope {
+	case "", ScopeCluster:
+		res, err = s.scanCluster(r, opts, readOpts)
+	case ScopeLocal:
+		if !s.canReadLocally(readOpts) {
+			s.redirectRead(s.shards().CurIdx, readOpts, w, r)
+			return
+		}
+		res, err = s.scanLocal(r, opts)
+	default:
+		s.writeError(w, r, CodeBadRequest, fmt.Errorf("unknown scope %q", scope))
+		return
+	}
+
+	if err != nil {
+		s.writeError(w, r, errorCode(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) scanLocal(r *http.Request, opts scanOptions) (*ScanResponse, error) {
+	shards := s.shards()
+
+	kvs, next, err := s.db.In(opts.ns).Scan(opts.prefix, opts.start, opts.end, opts.limit)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ScanResponse{
+		Results: make([]Response, 0, len(kvs)),
+		Next:    encodeToken(next),
+	}
+	for _, kv := range kvs {
+		kr := s.keyResponse(r, kv.Key, shards.NamespaceIndex(opts.ns, kv.Key))
+		kr.setValue(kv.Value, kv.Meta)
+		res.Results = append(res.Results, *kr)
+	}
+	return res, nil
+}
+
+// scanCluster scans every shard in parallel and merges the results.
+// Every shard returns up to limit keys, so the first limit keys of
+// the merged results are the first limit keys in the whole cluster.
+// Every key is returned once, from the shard that owns it. During resharding
+// the keys that have not been moved yet are returned from their previous owners
+// until the owner has them, but so are the keys that have been deleted on
+// the owner until they are moved.
+func (s *Server) scanCluster(r *http.Request, opts scanOptions, readOpts readOptions) (*ScanResponse, error) {
+	shards := s.shards()
+
+	parts := make([]*ScanResponse, shards.Count)
+	errs := make([]error, shards.Count)
+
+	var wg sync.WaitGroup
+	for shard := 0; shard < shards.Count; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			parts[shard], errs[shard] = s.scanShard(r, shard, opts, readOpts)
+		}(shard)
+	}
+	wg.Wait()
+
+	var next string
+	var results []Response
+	owned := make(map[string]bool)
+	for shard, part := range parts {
+		if errs[shard] != nil {
+			return nil, fmt.Errorf("scanning shard %d: %w", shard, errs[shard])
+		}
+
+		if part.Next != "" {
+			start, err := base64.RawURLEncoding.DecodeString(part.Next)
+			if err != nil {
+				return nil, fmt.Errorf("invalid token from shard %d: %w", shard, err)
+			}
+			if next == "" || string(start) < next {
+				next = string(start)
+			}
+		}
+
+		for _, kr := range part.Results {
+			if shards.NamespaceIndex(opts.ns, kr.Key) == shard {
+				owned[kr.Key] = true
+				results = append(results, kr)
+			}
+		}
+	}
+
+	// The owner has scanned all keys before the next one, so the keys it did not
+	// return and that other shards have are not moved to it yet.
+	for shard, part := range parts {
+		for _, kr := range part.Results {
+			if shards.NamespaceIndex(opts.ns, kr.Key) != shard && !owned[kr.Key] {
+				owned[kr.Key] = true
+				results = append(results, kr)
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Key < results[j].Key
+	})
+
+	if len(results) > opts.limit {
+		if k := results[opts.limit].Key; next == "" || k < next {
+			next = k
+		}
+		results = results[:opts.limit]
+	}
+
+	// The keys after the next one are returned with the next page.
+	for i, kr := range results {
+		if next != "" && kr.Key >= next {
+			results = results[:i]
+			break
+		}
+	}
+
+	if results == nil {
+		results = []Response{}
+	}
+	return &ScanResponse{Results: results, Next: encodeToken(next)}, nil
+}
+
+// scanShard scans the shard locally or on the node that can serve the read.
+func (s *Server) scanShard(r *http.Request, shard int, opts scanOptions, readOpts readOptions) (*ScanResponse, error) {
+	shards := s.shards()
+
+	if shard == shards.CurIdx && s.canReadLocally(readOpts) {
+		return s.scanLocal(r, opts)
+	}
+
+	if shard != shards.CurIdx && readOpts.consistency != ConsistencyLeader {
+		if addr, ok := s.nextReplica(shard); ok {
+			if res, err := s.remoteScan(r, addr, opts, readOpts); err == nil {
+				return res, nil
+			}
+		}
+	}
+
+	return s.remoteScan(r, shards.Addrs[shard], opts, readOpts)
+}
+
+func (s *Server) remoteScan(r *http.Request, addr string, opts scanOptions, readOpts readOptions) (*ScanResponse, error) {
+	q := url.Values{}
+	opts.encode(q)
+	readOpts.encode(q)
+	q.Set("scope", ScopeLocal)
+
+	req, err := s.newForwardRequest(r, http.MethodGet, "http://"+addr+scanPath+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %q from %q: %s", resp.Status, addr, result)
+	}
+
+	var res ScanResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -1,109 +1,623 @@
 package web
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/YuriyNasretdinov/distribkv/config"
 	"github.com/YuriyNasretdinov/distribkv/db"
 	"github.com/YuriyNasretdinov/distribkv/replication"
 )
 
+const (
+	defaultReplicationLimit = 1000
+	defaultReplicationBytes = 1 << 20
+	maxReplicationWait      = time.Minute
+
+	// DefaultMaxValueSize is the default limit of the value size in write requests.
+	DefaultMaxValueSize = 32 << 20
+)
+
 // Server contains HTTP method handlers to be used for the database.
 type Server struct {
-	db     *db.Database
-	shards *config.Shards
+	readCounter uint64
+
+	db         db.Store
+	curShards  atomic.Value // *config.Shards
+	migrations migrations
+
+	// Replication is set when the server runs as a replica.
+	Replication *replication.Client
+	// DefaultConsistency is used for reads that do not specify the consistency level.
+	DefaultConsistency Consistency
+	// MaxStaleness is the default replica lag allowed for bounded-staleness reads.
+	MaxStaleness time.Duration
+	// DefaultRouting is used for requests that do not specify the routing mode.
+	DefaultRouting Routing
+	// Addr is the address of the current node reported in the responses.
+	// The address of the current shard from the config is used when it is empty.
+	Addr string
+	// MaxValueSize limits the size of the values in write requests.
+	// DefaultMaxValueSize is used when it is zero.
+	MaxValueSize int64
 }
 
 // NewServer creates a new instance with HTTP handlers to be used to get and set values.
-func NewServer(db *db.Database, s *config.Shards) *Server {
-	return &Server{
-		db:     db,
-		shards: s,
+func NewServer(db db.Store, s *config.Shards) *Server {
+	srv := &Server{db: db}
+	srv.curShards.Store(s)
+	return srv
+}
+
+// shards returns the current sharding config.
+func (s *Server) shards() *config.Shards {
+	return s.curShards.Load().(*config.Shards)
+}
+
+// SetShards atomically replaces the sharding config.
+// Requests that are being processed may still use the previous config.
+// If the keys are placed differently in the new config, the leader starts
+// the migration from the previous config like with MigrateFrom.
+func (s *Server) SetShards(shards *config.Shards) {
+	prev := s.shards()
+	s.curShards.Store(shards)
+
+	if s.Replication == nil && !prev.SamePlacement(shards) {
+		s.MigrateFrom(prev)
 	}
 }
 
-func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
-	url := "http://" + s.shards.Addrs[shard] + r.RequestURI
-	fmt.Fprintf(w, "redirecting from shard %d to shard %d (%q)\n", s.shards.CurIdx, shard, url)
+// MigrateFrom makes the current shard read the keys it does not have yet
+// from their owners in the previous config until they move the keys to it
+// with /reshard. The keys written or deleted locally in the meantime
+// are not overwritten by the moved ones.
+func (s *Server) MigrateFrom(prev *config.Shards) {
+	shards := s.shards()
+	s.migrations.start(prev, shards.Addrs[shards.CurIdx])
+}
+
+// CheckEpoch rejects the requests from the nodes that have a different
+// config epoch. Requests without the epoch header, e.g. from clients,
+// are always accepted. The epoch of the current node is sent in every response.
+func (s *Server) CheckEpoch(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		epoch := s.shards().Epoch
+		w.Header().Set(config.EpochHeader, strconv.FormatInt(epoch, 10))
 
-	resp, err := http.Get(url)
+		if e := r.Header.Get(config.EpochHeader); e != "" && e != strconv.FormatInt(epoch, 10) {
+			s.writeError(w, r, CodeEpochMismatch, fmt.Errorf("config epoch mismatch: the request is from a node with epoch %s, current node has epoch %d", e, epoch))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newRequest creates a request to another node with the current config epoch.
+func (s *Server) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error redirecting the request: %v", err)
+		return nil, err
+	}
+
+	req.Header.Set(config.EpochHeader, strconv.FormatInt(s.shards().Epoch, 10))
+	return req, nil
+}
+
+// StatusHandler shows the config the current node is running with.
+func (s *Server) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+	stopped := s.Replication != nil && s.Replication.Stopped()
+
+	if wantJSON(r) {
+		writeJSON(w, http.StatusOK, &StatusResponse{
+			Node:               s.node(),
+			Epoch:              shards.Epoch,
+			Shard:              shards.CurIdx,
+			ShardCount:         shards.Count,
+			Replica:            s.Replication != nil,
+			ReplicationStopped: stopped,
+		})
 		return
 	}
-	defer resp.Body.Close()
 
-	io.Copy(w, resp.Body)
+	fmt.Fprintf(w, "Epoch = %d, current shard = %d, shard count = %d, replica = %v", shards.Epoch, shards.CurIdx, shards.Count, s.Replication != nil)
+	if stopped {
+		fmt.Fprint(w, ", replication stopped until resync")
+	}
 }
 
 // GetHandler handles read requests from the database.
+// Depending on the consistency level the reads can be served by replicas.
 func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+
 	r.ParseForm()
 	key := r.Form.Get("key")
+	ns := r.Form.Get("ns")
+
+	opts, err := s.readOptions(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
 
-	shard := s.shards.Index(key)
+	shard := shards.NamespaceIndex(ns, key)
 
-	if shard != s.shards.CurIdx {
-		s.redirect(shard, w, r)
+	if shard != shards.CurIdx || !s.canReadLocally(opts) {
+		s.redirectRead(shard, opts, w, r)
+		return
+	}
+
+	value, meta, err := s.readKey(ns, key)
+
+	if wantJSON(r) {
+		res := s.keyResponse(r, key, shard)
+		if err == nil && value == nil {
+			err = fmt.Errorf("%w: %q", errNotFound, key)
+		} else if value != nil {
+			res.setValue(value, meta)
+		}
+		writeResult(w, res, err)
 		return
 	}
 
-	value, err := s.db.GetKey(key)
+	fmt.Fprintf(w, "Shard = %d, current shard = %d, addr = %q, Value = %q, error = %v", shard, shards.CurIdx, shards.Addrs[shard], value, err)
+}
+
+// readValue reads the value of the write request from the request body.
+// Values larger than MaxValueSize are rejected.
+func (s *Server) readValue(r *http.Request) ([]byte, error) {
+	limit := s.MaxValueSize
+	if limit <= 0 {
+		limit = DefaultMaxValueSize
+	}
+
+	value, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(value)) > limit {
+		return nil, fmt.Errorf("%w: the limit is %d bytes", errTooLarge, limit)
+	}
+	return value, nil
+}
+
+// isFormBody reports whether the request body has the form Content-Type.
+func isFormBody(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
+
+// parseTTL parses the time to live of the key.
+// The empty string means that the key does not expire.
+func parseTTL(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
 
-	fmt.Fprintf(w, "Shard = %d, current shard = %d, addr = %q, Value = %q, error = %v", shard, s.shards.CurIdx, s.shards.Addrs[shard], value, err)
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl: %w", err)
+	} else if ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q: must be positive", v)
+	}
+	return ttl, nil
 }
 
 // SetHandler handles write requests from the database.
+// The value is taken from the "value" parameter if it is present
+// and from the request body otherwise. The write can be made conditional
+// with the "if-absent", "if-value" and "if-etag" parameters, and the key
+// expires after the duration from the "ttl" parameter, e.g. "30s".
 func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+
+	// Clients like curl --data-binary send the raw value with the form
+	// Content-Type. When the key is in the query string, such a body is read
+	// as the value and the parameters are only taken from the query string.
+	// Otherwise the body is the form with the key and the value.
+	var body []byte
+	rawBody := isFormBody(r) && r.URL.Query().Has("key")
+	if rawBody {
+		var err error
+		if body, err = s.readValue(r); err != nil {
+			s.writeError(w, r, errorCode(err), err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.Form = r.URL.Query()
+	} else {
+		r.ParseForm()
+	}
+
+	key := r.Form.Get("key")
+	ns := r.Form.Get("ns")
+
+	shard := shards.NamespaceIndex(ns, key)
+	if shard != shards.CurIdx {
+		s.redirect(shard, w, r)
+		return
+	}
+
+	cond, err := formCondition(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	ttl, err := parseTTL(r.Form.Get("ttl"))
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	opts := db.SetOptions{Condition: cond, TTL: ttl}
+
+	var value []byte
+	if v, ok := r.Form["value"]; ok {
+		value = []byte(v[0])
+	} else {
+		value = body
+		if !rawBody {
+			if value, err = s.readValue(r); err != nil {
+				s.writeError(w, r, errorCode(err), err)
+				return
+			}
+		}
+		opts.ContentType = r.Header.Get("Content-Type")
+	}
+
+	var meta db.Meta
+	err = s.writeKey(ns, key, cond, func() (err error) {
+		meta, err = s.db.In(ns).SetKeyWith(key, value, opts)
+		return err
+	})
+	if wantJSON(r) {
+		res := s.keyResponse(r, key, shard)
+		if err == nil {
+			res.setMeta(meta)
+		}
+		writeResult(w, res, err)
+		return
+	}
+	fmt.Fprintf(w, "Error = %v, shardIdx = %d, current shard = %d", err, shard, shards.CurIdx)
+}
+
+// DeleteHandler handles delete requests to the database.
+// The deletion can be made conditional like in SetHandler.
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+
+	r.ParseForm()
+	key := r.Form.Get("key")
+	ns := r.Form.Get("ns")
+
+	shard := shards.NamespaceIndex(ns, key)
+	if shard != shards.CurIdx {
+		s.redirect(shard, w, r)
+		return
+	}
+
+	cond, err := formCondition(r)
+	if err != nil {
+		s.writeError(w, r, CodeBadRequest, err)
+		return
+	}
+
+	err = s.writeKey(ns, key, cond, func() error {
+		return s.db.In(ns).DeleteKeyIf(key, cond)
+	})
+	if wantJSON(r) {
+		writeResult(w, s.keyResponse(r, key, shard), err)
+		return
+	}
+	fmt.Fprintf(w, "Error = %v, shardIdx = %d, current shard = %d", err, shard, shards.CurIdx)
+}
+
+// IncrementHandler atomically adds the "delta" parameter, 1 by default,
+// to the integer value of the key and returns the resulting value.
+// Replicas send the increments to the leader of their shard.
+func (s *Server) IncrementHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.shards()
+
 	r.ParseForm()
 	key := r.Form.Get("key")
-	value := r.Form.Get("value")
+	ns := r.Form.Get("ns")
 
-	shard := s.shards.Index(key)
-	if shard != s.shards.CurIdx {
+	shard := shards.NamespaceIndex(ns, key)
+	if shard != shards.CurIdx || s.Replication != nil {
 		s.redirect(shard, w, r)
 		return
 	}
 
-	err := s.db.SetKey(key, []byte(value))
-	fmt.Fprintf(w, "Error = %v, shardIdx = %d, current shard = %d", err, shard, s.shards.CurIdx)
+	delta := int64(1)
+	if v := r.Form.Get("delta"); v != "" {
+		var err error
+		if delta, err = strconv.ParseInt(v, 10, 64); err != nil {
+			s.writeError(w, r, CodeBadRequest, fmt.Errorf("invalid delta: %w", err))
+			return
+		}
+	}
+
+	var value int64
+	var meta db.Meta
+	err := s.updateKey(ns, key, func() (err error) {
+		value, meta, err = s.db.In(ns).Increment(key, delta)
+		return err
+	})
+	if wantJSON(r) {
+		res := s.keyResponse(r, key, shard)
+		if err == nil {
+			res.setValue([]byte(strconv.FormatInt(value, 10)), meta)
+		}
+		writeResult(w, res, err)
+		return
+	}
+	fmt.Fprintf(w, "Error = %v, value = %d, shardIdx = %d, current shard = %d", err, value, shard, shards.CurIdx)
 }
 
-// DeleteExtraKeysHandler deletes keys that don't belong to the current shard.
+// DeleteExtraKeysHandler deletes keys that don't belong to the current shard
+// from all namespaces.
 func (s *Server) DeleteExtraKeysHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Error = %v", s.db.DeleteExtraKeys(func(key string) bool {
-		return s.shards.Index(key) != s.shards.CurIdx
-	}))
+	err := s.deleteExtraKeys()
+	if wantJSON(r) {
+		writeResult(w, s.newResponse(r), err)
+		return
+	}
+	fmt.Fprintf(w, "Error = %v", err)
+}
+
+func (s *Server) deleteExtraKeys() error {
+	shards := s.shards()
+
+	names, err := s.namespaces()
+	if err != nil {
+		return err
+	}
+
+	for _, ns := range names {
+		err := s.db.In(ns).DeleteExtraKeys(func(key string) bool {
+			return shards.NamespaceIndex(ns, key) != shards.CurIdx
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReplica returns an error if the replica is not listed
+// in the config for the current shard.
+func (s *Server) checkReplica(replica string) error {
+	shards := s.shards()
+
+	if !shards.IsReplica(shards.CurIdx, replica) {
+		return fmt.Errorf("replica %q is not configured for shard %d", replica, shards.CurIdx)
+	}
+	return nil
+}
+
+// replicationWait returns the duration from the "wait" parameter
+// for which the replication requests are held open when there are no changes.
+func replicationWait(r *http.Request) (time.Duration, error) {
+	w := r.Form.Get("wait")
+	if w == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(w)
+	if err != nil {
+		return 0, err
+	}
+
+	if wait > maxReplicationWait {
+		wait = maxReplicationWait
+	}
+	return wait, nil
+}
+
+// longPoll calls fetch until it finds the changes, the wait duration passes
+// or the client goes away. The fetch is called immediately after each
+// change is appended to the replication log.
+func (s *Server) longPoll(r *http.Request, wait time.Duration, fetch func() (found bool, err error)) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		changed := s.db.Changed()
+
+		found, err := fetch()
+		if err != nil || found || wait <= 0 {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
 }
 
-// GetNextKeyForReplication returns the next key for replication.
+// GetNextKeyForReplication returns the next change after the sequence number
+// provided in the "after" parameter. If there are no changes, the request
+// is held open for the duration from the "wait" parameter.
 func (s *Server) GetNextKeyForReplication(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	replica := r.Form.Get("replica")
+
 	enc := json.NewEncoder(w)
-	k, v, err := s.db.GetNextKeyForReplication()
+
+	after, err := strconv.ParseUint(r.Form.Get("after"), 10, 64)
+	if err != nil {
+		enc.Encode(&replication.NextKeyValue{Err: err.Error()})
+		return
+	}
+
+	if err := s.checkReplica(replica); err != nil {
+		enc.Encode(&replication.NextKeyValue{Err: err.Error()})
+		return
+	}
+
+	wait, err := replicationWait(r)
+	if err != nil {
+		enc.Encode(&replication.NextKeyValue{Err: err.Error()})
+		return
+	}
+
+	var e *db.LogEntry
+	err = s.longPoll(r, wait, func() (found bool, err error) {
+		e, err = s.db.GetNextKeyForReplication(after)
+		return e != nil, err
+	})
+	if err != nil {
+		enc.Encode(&replication.NextKeyValue{Err: err.Error()})
+		return
+	}
+	if e == nil {
+		enc.Encode(&replication.NextKeyValue{})
+		return
+	}
+
 	enc.Encode(&replication.NextKeyValue{
-		Key:   string(k),
-		Value: string(v),
-		Err:   err,
+		Seq:         e.Seq,
+		Op:          e.Op,
+		Namespace:   e.Namespace,
+		Key:         e.Key,
+		Value:       e.Value,
+		Modified:    e.Modified,
+		ContentType: e.ContentType,
+		Expires:     e.Expires,
 	})
 }
 
-// DeleteReplicationKey deletes the key from replica queue.
-func (s *Server) DeleteReplicationKey(w http.ResponseWriter, r *http.Request) {
+// GetNextKeysForReplication returns a batch of changes after the sequence number
+// provided in the "after" parameter. The batch size is limited by the "limit"
+// and "max-bytes" parameters. If there are no changes, the request
+// is held open for the duration from the "wait" parameter.
+func (s *Server) GetNextKeysForReplication(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
+	replica := r.Form.Get("replica")
 
-	key := r.Form.Get("key")
-	value := r.Form.Get("value")
+	enc := json.NewEncoder(w)
+
+	after, err := strconv.ParseUint(r.Form.Get("after"), 10, 64)
+	if err != nil {
+		enc.Encode(&replication.NextKeyValues{Err: err.Error()})
+		return
+	}
+
+	limit := defaultReplicationLimit
+	if l := r.Form.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			enc.Encode(&replication.NextKeyValues{Err: err.Error()})
+			return
+		}
+	}
+
+	maxBytes := defaultReplicationBytes
+	if b := r.Form.Get("max-bytes"); b != "" {
+		if maxBytes, err = strconv.Atoi(b); err != nil {
+			enc.Encode(&replication.NextKeyValues{Err: err.Error()})
+			return
+		}
+	}
+
+	if err := s.checkReplica(replica); err != nil {
+		enc.Encode(&replication.NextKeyValues{Err: err.Error()})
+		return
+	}
+
+	wait, err := replicationWait(r)
+	if err != nil {
+		enc.Encode(&replication.NextKeyValues{Err: err.Error()})
+		return
+	}
+
+	var entries []db.LogEntry
+	err = s.longPoll(r, wait, func() (found bool, err error) {
+		entries, err = s.db.GetNextKeysForReplication(after, limit, maxBytes)
+		return len(entries) > 0, err
+	})
+	if err != nil {
+		enc.Encode(&replication.NextKeyValues{Err: err.Error(), Truncated: errors.Is(err, db.ErrLogTruncated)})
+		return
+	}
+
+	lastSeq, err := s.db.LastSeq()
+	if err != nil {
+		enc.Encode(&replication.NextKeyValues{Err: err.Error()})
+		return
+	}
+
+	enc.Encode(&replication.NextKeyValues{
+		Entries: replication.NewNextKeyValues(entries),
+		LastSeq: lastSeq,
+	})
+}
+
+// ReplicationSnapshot returns all namespaces and keys of the leader together
+// with the sequence number of the last change they include. The replicas
+// that cannot catch up with the leader by replication are resynced from it.
+func (s *Server) ReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	replica := r.Form.Get("replica")
+
+	enc := json.NewEncoder(w)
+
+	if err := s.checkReplica(replica); err != nil {
+		enc.Encode(&replication.Snapshot{Err: err.Error()})
+		return
+	}
+
+	seq, entries, err := s.db.Snapshot()
+	if err != nil {
+		enc.Encode(&replication.Snapshot{Err: err.Error()})
+		return
+	}
+
+	enc.Encode(&replication.Snapshot{
+		Seq:     seq,
+		Entries: replication.NewNextKeyValues(entries),
+	})
+}
+
+// AckReplication records that the replica has applied all changes
+// up to the provided sequence number.
+func (s *Server) AckReplication(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	replica := r.Form.Get("replica")
+
+	seq, err := strconv.ParseUint(r.Form.Get("seq"), 10, 64)
+	if err == nil {
+		err = s.checkReplica(replica)
+	}
+	if err == nil {
+		err = s.db.AckReplication(replica, seq)
+	}
 
-	err := s.db.DeleteReplicationKey([]byte(key), []byte(value))
 	if err != nil {
+		if wantJSON(r) {
+			s.writeError(w, r, CodeBadRequest, err)
+			return
+		}
 		w.WriteHeader(http.StatusExpectationFailed)
 		fmt.Fprintf(w, "error: %v", err)
 		return
 	}
 
-	fmt.Fprintf(w, "ok")
+	s.writeOK(w, r)
 }
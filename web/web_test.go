@@ -2,22 +2,40 @@ package web_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/YuriyNasretdinov/distribkv/config"
+	"github.com/YuriyNasretdinov/distribkv/replication"
 	"github.com/YuriyNasretdinov/distribkv/web"
 
 	"github.com/YuriyNasretdinov/distribkv/db"
 )
 
-func createShardDb(t *testing.T, idx int) *db.Database {
+// engines are the storage engines that every test runs against.
+var engines = []db.Engine{db.EngineBolt, db.EngineMemory, db.EngineLog}
+
+// forEachEngine runs the test against every storage engine.
+func forEachEngine(t *testing.T, test func(t *testing.T, engine db.Engine)) {
+	for _, e := range engines {
+		t.Run(string(e), func(t *testing.T) { test(t, e) })
+	}
+}
+
+func createShardDb(t *testing.T, engine db.Engine, idx int) *db.Database {
 	t.Helper()
 
 	tmpFile, err := ioutil.TempFile(os.TempDir(), fmt.Sprintf("db%d", idx))
@@ -30,7 +48,7 @@ func createShardDb(t *testing.T, idx int) *db.Database {
 	name := tmpFile.Name()
 	t.Cleanup(func() { os.Remove(name) })
 
-	db, closeFunc, err := db.NewDatabase(name, false)
+	db, closeFunc, err := db.Open(engine, name, false)
 	if err != nil {
 		t.Fatalf("Could not create new database %q: %v", name, err)
 	}
@@ -39,10 +57,10 @@ func createShardDb(t *testing.T, idx int) *db.Database {
 	return db
 }
 
-func createShardServer(t *testing.T, idx int, addrs map[int]string) (*db.Database, *web.Server) {
+func createShardServer(t *testing.T, engine db.Engine, idx int, addrs map[int]string) (*db.Database, *web.Server) {
 	t.Helper()
 
-	db := createShardDb(t, idx)
+	db := createShardDb(t, engine, idx)
 
 	cfg := &config.Shards{
 		Addrs:  addrs,
@@ -54,15 +72,54 @@ func createShardServer(t *testing.T, idx int, addrs map[int]string) (*db.Databas
 	return db, s
 }
 
-func TestWebServer(t *testing.T) {
-	var ts1GetHandler, ts1SetHandler func(w http.ResponseWriter, r *http.Request)
-	var ts2GetHandler, ts2SetHandler func(w http.ResponseWriter, r *http.Request)
+// testCluster is a cluster of two shards with a single node in each.
+type testCluster struct {
+	ts1, ts2   *httptest.Server
+	db1, db2   *db.Database
+	web1, web2 *web.Server
+	addrs      map[int]string
+}
+
+// newTestCluster starts the nodes of both shards. The servers can be
+// configured before the first request is sent to them.
+func newTestCluster(t *testing.T, engine db.Engine) *testCluster {
+	t.Helper()
+
+	c := &testCluster{
+		ts1: httptest.NewServer(nil),
+		ts2: httptest.NewServer(nil),
+	}
+	c.addrs = map[int]string{
+		0: strings.TrimPrefix(c.ts1.URL, "http://"),
+		1: strings.TrimPrefix(c.ts2.URL, "http://"),
+	}
+
+	c.db1, c.web1 = createShardServer(t, engine, 0, c.addrs)
+	c.db2, c.web2 = createShardServer(t, engine, 1, c.addrs)
+	c.ts1.Config.Handler = newMux(c.web1)
+	c.ts2.Config.Handler = newMux(c.web2)
+
+	// The servers are stopped before the databases are closed.
+	t.Cleanup(func() {
+		c.ts1.Close()
+		c.ts2.Close()
+	})
+	return c
+}
+
+func TestWebServer(t *testing.T) { forEachEngine(t, testWebServer) }
+
+func testWebServer(t *testing.T, engine db.Engine) {
+	var ts1GetHandler, ts1SetHandler, ts1DeleteHandler func(w http.ResponseWriter, r *http.Request)
+	var ts2GetHandler, ts2SetHandler, ts2DeleteHandler func(w http.ResponseWriter, r *http.Request)
 
 	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.RequestURI, "/get") {
 			ts1GetHandler(w, r)
 		} else if strings.HasPrefix(r.RequestURI, "/set") {
 			ts1SetHandler(w, r)
+		} else if strings.HasPrefix(r.RequestURI, "/delete") {
+			ts1DeleteHandler(w, r)
 		}
 	}))
 	defer ts1.Close()
@@ -72,6 +129,8 @@ func TestWebServer(t *testing.T) {
 			ts2GetHandler(w, r)
 		} else if strings.HasPrefix(r.RequestURI, "/set") {
 			ts2SetHandler(w, r)
+		} else if strings.HasPrefix(r.RequestURI, "/delete") {
+			ts2DeleteHandler(w, r)
 		}
 	}))
 	defer ts2.Close()
@@ -81,8 +140,8 @@ func TestWebServer(t *testing.T) {
 		1: strings.TrimPrefix(ts2.URL, "http://"),
 	}
 
-	db1, web1 := createShardServer(t, 0, addrs)
-	db2, web2 := createShardServer(t, 1, addrs)
+	db1, web1 := createShardServer(t, engine, 0, addrs)
+	db2, web2 := createShardServer(t, engine, 1, addrs)
 
 	// Calculated manually and depends on the sharding function.
 	keys := map[string]int{
@@ -94,6 +153,8 @@ func TestWebServer(t *testing.T) {
 	ts1SetHandler = web1.SetHandler
 	ts2GetHandler = web2.GetHandler
 	ts2SetHandler = web2.SetHandler
+	ts1DeleteHandler = web1.DeleteHandler
+	ts2DeleteHandler = web2.DeleteHandler
 
 	for key := range keys {
 		// Send all to first shard to test redirects.
@@ -141,4 +202,1156 @@ func TestWebServer(t *testing.T) {
 	if !bytes.Equal(value2, []byte(want2)) {
 		t.Errorf("Unexpected value of Soviet key: got %q, want %q", value2, want2)
 	}
+
+	// Send to the first shard to test redirects.
+	if _, err := http.Get(ts1.URL + "/delete?key=Soviet"); err != nil {
+		t.Fatalf("Could not delete the Soviet key: %v", err)
+	}
+
+	value2, err = db2.GetKey("Soviet")
+	if err != nil {
+		t.Fatalf("Soviet key error: %v", err)
+	}
+
+	if value2 != nil {
+		t.Errorf("Unexpected value of Soviet key after deletion: got %q, want nil", value2)
+	}
+}
+
+func TestReplicationLongPoll(t *testing.T) { forEachEngine(t, testReplicationLongPoll) }
+
+func testReplicationLongPoll(t *testing.T, engine db.Engine) {
+	ts := httptest.NewServer(nil)
+	defer ts.Close()
+
+	db := createShardDb(t, engine, 0)
+	srv := web.NewServer(db, &config.Shards{
+		Addrs:    map[int]string{0: strings.TrimPrefix(ts.URL, "http://")},
+		Replicas: map[int][]string{0: {"replica"}},
+		Count:    1,
+		CurIdx:   0,
+	})
+	ts.Config.Handler = http.HandlerFunc(srv.GetNextKeysForReplication)
+
+	if err := db.SetReplicas([]string{"replica"}); err != nil {
+		t.Fatalf("SetReplicas() failed: %v", err)
+	}
+
+	type result struct {
+		res replication.NextKeyValues
+		err error
+	}
+	ch := make(chan result, 1)
+
+	go func() {
+		var res result
+		resp, err := http.Get(ts.URL + "/next-replication-keys?replica=replica&after=0&wait=10s")
+		if err != nil {
+			res.err = err
+		} else {
+			defer resp.Body.Close()
+			res.err = json.NewDecoder(resp.Body).Decode(&res.res)
+		}
+		ch <- res
+	}()
+
+	select {
+	case res := <-ch:
+		t.Fatalf("Request returned before any changes: %+v, %v", res.res, res.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := db.SetKey("party", []byte("Great")); err != nil {
+		t.Fatalf("SetKey() failed: %v", err)
+	}
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			t.Fatalf("Request failed: %v", res.err)
+		}
+		if len(res.res.Entries) != 1 || res.res.Entries[0].Key != "party" || string(res.res.Entries[0].Value) != "Great" {
+			t.Errorf("Unexpected entries: got %+v, want a single entry for %q", res.res.Entries, "party")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Request was not completed after the change")
+	}
+}
+
+func TestReplicationLogTruncated(t *testing.T) { forEachEngine(t, testReplicationLogTruncated) }
+
+func testReplicationLogTruncated(t *testing.T, engine db.Engine) {
+	ts := httptest.NewServer(nil)
+	defer ts.Close()
+
+	leader := createShardDb(t, engine, 0)
+	srv := web.NewServer(leader, &config.Shards{
+		Addrs:    map[int]string{0: strings.TrimPrefix(ts.URL, "http://")},
+		Replicas: map[int][]string{0: {"first", "second"}},
+		Count:    1,
+		CurIdx:   0,
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/next-replication-keys", srv.GetNextKeysForReplication)
+	mux.HandleFunc("/replication-snapshot", srv.ReplicationSnapshot)
+	mux.HandleFunc("/ack-replication", srv.AckReplication)
+	ts.Config.Handler = mux
+
+	if err := leader.SetReplicas([]string{"first"}); err != nil {
+		t.Fatalf("SetReplicas() failed: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := leader.SetKey(key, []byte("value")); err != nil {
+			t.Fatalf("SetKey(%q) failed: %v", key, err)
+		}
+	}
+	if err := leader.AckReplication("first", 2); err != nil {
+		t.Fatalf("AckReplication() failed: %v", err)
+	}
+	// The second replica is added after the first changes were removed.
+	if err := leader.SetReplicas([]string{"first", "second"}); err != nil {
+		t.Fatalf("SetReplicas() failed: %v", err)
+	}
+
+	replica := createShardDb(t, engine, 1)
+	c := replication.NewClient(replica, strings.TrimPrefix(ts.URL, "http://"), "second", 0)
+
+	done := make(chan struct{})
+	go func() {
+		c.Loop()
+		close(done)
+	}()
+	defer func() {
+		c.Stop()
+		<-done
+	}()
+
+	// The replica is resynced from the leader snapshot and then
+	// replicates the changes made after it.
+	waitReplicated := func(key string, seq uint64) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			applied, err := replica.AppliedSeq()
+			if err != nil {
+				t.Fatalf("AppliedSeq() on the replica failed: %v", err)
+			}
+			if applied >= seq {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("AppliedSeq() on the replica: got %d, want %d", applied, seq)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if value, err := replica.GetKey(key); err != nil || string(value) != "value" {
+			t.Errorf("GetKey(%q) on the replica: got %q, %v; want %q, nil", key, value, err, "value")
+		}
+	}
+
+	waitReplicated("a", 2)
+	waitReplicated("b", 2)
+
+	if c.Stopped() {
+		t.Errorf("Stopped() after the resync: got true, want false")
+	}
+	if s := c.Staleness(); s == time.Duration(math.MaxInt64) {
+		t.Errorf("Staleness() after the resync: got the maximum duration")
+	}
+
+	if err := leader.SetKey("c", []byte("value")); err != nil {
+		t.Fatalf("SetKey(%q) failed: %v", "c", err)
+	}
+	waitReplicated("c", 3)
+}
+
+func TestReplicationStaleness(t *testing.T) { forEachEngine(t, testReplicationStaleness) }
+
+func testReplicationStaleness(t *testing.T, engine db.Engine) {
+	var requests int32
+	release := make(chan struct{})
+
+	// The leader answers the first request and then stops responding.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			json.NewEncoder(w).Encode(&replication.NextKeyValues{})
+			return
+		}
+		<-release
+		json.NewEncoder(w).Encode(&replication.NextKeyValues{Truncated: true})
+	}))
+	defer ts.Close()
+
+	replica := createShardDb(t, engine, 0)
+	c := replication.NewClient(replica, strings.TrimPrefix(ts.URL, "http://"), "replica", 0)
+
+	done := make(chan struct{})
+	go func() {
+		c.Loop()
+		close(done)
+	}()
+	defer func() {
+		c.Stop()
+		close(release)
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Staleness() > time.Second {
+		if time.Now().After(deadline) {
+			t.Fatalf("Staleness() after the leader response: got %v, want at most 1s", c.Staleness())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if s := c.Staleness(); s < 300*time.Millisecond {
+		t.Errorf("Staleness() while the leader does not respond: got %v, want at least 300ms", s)
+	}
+}
+
+func TestReadConsistency(t *testing.T) { forEachEngine(t, testReadConsistency) }
+
+func testReadConsistency(t *testing.T, engine db.Engine) {
+	ts1 := httptest.NewServer(nil)
+	defer ts1.Close()
+	ts2 := httptest.NewServer(nil)
+	defer ts2.Close()
+	ts2Replica := httptest.NewServer(nil)
+	defer ts2Replica.Close()
+
+	cfg := config.Shards{
+		Addrs: map[int]string{
+			0: strings.TrimPrefix(ts1.URL, "http://"),
+			1: strings.TrimPrefix(ts2.URL, "http://"),
+		},
+		Replicas: map[int][]string{
+			1: {strings.TrimPrefix(ts2Replica.URL, "http://")},
+		},
+		Count: 2,
+	}
+
+	newServer := func(ts *httptest.Server, idx int) *db.Database {
+		db := createShardDb(t, engine, idx)
+		c := cfg
+		c.CurIdx = idx
+		ts.Config.Handler = http.HandlerFunc(web.NewServer(db, &c).GetHandler)
+		return db
+	}
+
+	newServer(ts1, 0)
+	leaderDb := newServer(ts2, 1)
+	replicaDb := newServer(ts2Replica, 1)
+
+	// "Soviet" belongs to the second shard. The values differ to find out
+	// which node has served the read.
+	if err := leaderDb.SetKey("Soviet", []byte("leader-value")); err != nil {
+		t.Fatalf("SetKey() on leader failed: %v", err)
+	}
+	if err := replicaDb.SetKey("Soviet", []byte("replica-value")); err != nil {
+		t.Fatalf("SetKey() on replica failed: %v", err)
+	}
+
+	for consistency, want := range map[string]string{
+		"":                  "leader-value",
+		"leader":            "leader-value",
+		"any":               "replica-value",
+		"bounded-staleness": "replica-value",
+	} {
+		resp, err := http.Get(ts1.URL + "/get?key=Soviet&consistency=" + consistency)
+		if err != nil {
+			t.Fatalf("Get with consistency %q failed: %v", consistency, err)
+		}
+		contents, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Could not read the response for consistency %q: %v", consistency, err)
+		}
+
+		if !bytes.Contains(contents, []byte(want)) {
+			t.Errorf("Get with consistency %q: got %q, want the result to contain %q", consistency, contents, want)
+		}
+	}
+
+	resp, err := http.Get(ts1.URL + "/get?key=Soviet&consistency=bogus")
+	if err != nil {
+		t.Fatalf("Get with bogus consistency failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Get with bogus consistency: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func newMux(s *web.Server) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", s.GetHandler)
+	mux.HandleFunc("/set", s.SetHandler)
+	mux.HandleFunc("/delete", s.DeleteHandler)
+	mux.HandleFunc("/incr", s.IncrementHandler)
+	mux.HandleFunc("/v1/keys/", s.KeysHandler)
+	mux.HandleFunc("/v1/batch/", s.BatchHandler)
+	mux.HandleFunc("/v1/scan", s.ScanHandler)
+	mux.HandleFunc("/v1/namespaces", s.NamespacesHandler)
+	mux.HandleFunc("/v1/namespaces/", s.NamespacesHandler)
+	mux.HandleFunc("/reshard", s.ReshardHandler)
+	mux.HandleFunc("/migrate-keys", s.MigrateKeysHandler)
+	mux.HandleFunc("/finish-migration", s.FinishMigrationHandler)
+	mux.HandleFunc("/local-get", s.LocalGetHandler)
+	return mux
+}
+
+func getBody(t *testing.T, url string) string {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %q failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read the response for %q: %v", url, err)
+	}
+
+	return string(contents)
+}
+
+func TestReshard(t *testing.T) { forEachEngine(t, testReshard) }
+
+func testReshard(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	// "Soviet", "Moscow" and "Kremlin" belong to the second shard
+	// but are stored on the first one, as if the second shard
+	// has just been added to the cluster of the first one.
+	for _, key := range []string{"Soviet", "Moscow", "Kremlin", "USA"} {
+		if err := c.db1.SetKey(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("SetKey(%q) failed: %v", key, err)
+		}
+	}
+
+	c.web2.MigrateFrom(&config.Shards{Addrs: map[int]string{0: c.addrs[0]}, Count: 1, CurIdx: 0})
+
+	if got := getBody(t, c.ts2.URL+"/get?key=Soviet"); !strings.Contains(got, "value-Soviet") {
+		t.Errorf("Reading a key that has not been moved yet: got %q, want the result to contain %q", got, "value-Soviet")
+	}
+
+	// The keys written or deleted during the migration must not be overwritten.
+	getBody(t, c.ts2.URL+"/set?key=Moscow&value=new-value")
+	getBody(t, c.ts2.URL+"/delete?key=Kremlin")
+
+	if got := getBody(t, c.ts2.URL+"/get?key=Kremlin"); strings.Contains(got, "value-Kremlin") {
+		t.Errorf("Reading a key deleted during the migration: got %q, want an empty value", got)
+	}
+
+	if got := getBody(t, c.ts1.URL+"/reshard"); !strings.Contains(got, "Error = <nil>") {
+		t.Fatalf("Resharding failed: %s", got)
+	}
+
+	for key, want := range map[string]string{"Soviet": "value-Soviet", "Moscow": "new-value", "Kremlin": ""} {
+		value, err := c.db2.GetKey(key)
+		if err != nil || string(value) != want {
+			t.Errorf("Value of %q on the new owner: got %q, %v; want %q, nil", key, value, err, want)
+		}
+
+		value, err = c.db1.GetKey(key)
+		if err != nil || value != nil {
+			t.Errorf("Value of %q on the previous owner: got %q, %v; want nil, nil", key, value, err)
+		}
+	}
+
+	if value, err := c.db1.GetKey("USA"); err != nil || string(value) != "value-USA" {
+		t.Errorf(`Value of "USA" on the first shard: got %q, %v; want %q, nil`, value, err, "value-USA")
+	}
+}
+
+func TestCheckEpoch(t *testing.T) { forEachEngine(t, testCheckEpoch) }
+
+func testCheckEpoch(t *testing.T, engine db.Engine) {
+	db := createShardDb(t, engine, 0)
+	srv := web.NewServer(db, &config.Shards{
+		Epoch:  2,
+		Addrs:  map[int]string{0: "localhost:8080"},
+		Count:  1,
+		CurIdx: 0,
+	})
+
+	ts := httptest.NewServer(srv.CheckEpoch(http.HandlerFunc(srv.SetHandler)))
+	defer ts.Close()
+
+	for epoch, want := range map[string]int{
+		"":  http.StatusOK,
+		"2": http.StatusOK,
+		"1": http.StatusConflict,
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/set?key=epoch-"+epoch+"&value=value", nil)
+		if err != nil {
+			t.Fatalf("NewRequest() failed: %v", err)
+		}
+		if epoch != "" {
+			req.Header.Set(config.EpochHeader, epoch)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request with epoch %q failed: %v", epoch, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Errorf("Request with epoch %q: got status %d, want %d", epoch, resp.StatusCode, want)
+		}
+
+		if got := resp.Header.Get(config.EpochHeader); got != "2" {
+			t.Errorf("Epoch in the response for request with epoch %q: got %q, want %q", epoch, got, "2")
+		}
+	}
+
+	if value, err := db.GetKey("epoch-1"); err != nil || value != nil {
+		t.Errorf("The key from the request with a mismatched epoch: got %q, %v; want nil, nil", value, err)
+	}
+}
+
+func doRequest(t *testing.T, method, url, body string) (status int, contents string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest(%q, %q) failed: %v", method, url, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %q failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read the response for %s %q: %v", method, url, err)
+	}
+
+	return resp.StatusCode, string(res)
+}
+
+func TestKeysAPI(t *testing.T) { forEachEngine(t, testKeysAPI) }
+
+func testKeysAPI(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	// All requests are sent to the first shard while "Soviet" belongs to the second one.
+	url := c.ts1.URL + "/v1/keys/Soviet"
+
+	steps := []struct {
+		method     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{http.MethodGet, "", http.StatusNotFound, ""},
+		{http.MethodPut, "value\x00with binary", http.StatusNoContent, ""},
+		{http.MethodGet, "", http.StatusOK, "value\x00with binary"},
+		{http.MethodPut, "", http.StatusNoContent, ""},
+		{http.MethodGet, "", http.StatusOK, ""},
+		{http.MethodDelete, "", http.StatusNoContent, ""},
+		{http.MethodGet, "", http.StatusNotFound, ""},
+		{http.MethodPost, "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, st := range steps {
+		status, body := doRequest(t, st.method, url, st.body)
+		if status != st.wantStatus {
+			t.Fatalf("%s %q: got status %d (%q), want %d", st.method, url, status, body, st.wantStatus)
+		}
+		if st.wantStatus < 300 && body != st.wantBody {
+			t.Errorf("%s %q: got body %q, want %q", st.method, url, body, st.wantBody)
+		}
+	}
+
+	if value, err := c.db2.GetKey("Soviet"); err != nil || value != nil {
+		t.Errorf("Soviet key after deletion: got %q, %v; want nil, nil", value, err)
+	}
+}
+
+func TestKeysAPIReadOnly(t *testing.T) { forEachEngine(t, testKeysAPIReadOnly) }
+
+func testKeysAPIReadOnly(t *testing.T, engine db.Engine) {
+	tmpFile, err := ioutil.TempFile(os.TempDir(), "readonly")
+	if err != nil {
+		t.Fatalf("Could not create a temp db: %v", err)
+	}
+	tmpFile.Close()
+
+	name := tmpFile.Name()
+	t.Cleanup(func() { os.Remove(name) })
+
+	db, closeFunc, err := db.Open(engine, name, true)
+	if err != nil {
+		t.Fatalf("Could not create new database %q: %v", name, err)
+	}
+	t.Cleanup(func() { closeFunc() })
+
+	srv := web.NewServer(db, &config.Shards{Addrs: map[int]string{0: "localhost:8080"}, Count: 1})
+	ts := httptest.NewServer(newMux(srv))
+	defer ts.Close()
+
+	if status, body := doRequest(t, http.MethodPut, ts.URL+"/v1/keys/party", "Great"); status != http.StatusForbidden {
+		t.Errorf("PUT to a read-only database: got status %d (%q), want %d", status, body, http.StatusForbidden)
+	}
+}
+
+func getJSON(t *testing.T, method, url, body string) (status int, res web.Response) {
+	t.Helper()
+
+	status, contents := doRequest(t, method, url, body)
+	if err := json.Unmarshal([]byte(contents), &res); err != nil {
+		t.Fatalf("%s %q: could not decode the response %q: %v", method, url, contents, err)
+	}
+
+	return status, res
+}
+
+func TestJSONResponses(t *testing.T) { forEachEngine(t, testJSONResponses) }
+
+func testJSONResponses(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	// "Soviet" belongs to the second shard, so the request is proxied.
+	status, res := getJSON(t, http.MethodGet, c.ts1.URL+"/set?key=Soviet&value=Moscow&format=json", "")
+	if status != http.StatusOK || res.Error != nil || res.Key != "Soviet" || res.Shard == nil || *res.Shard != 1 || res.Node != c.addrs[1] || !res.Proxied {
+		t.Errorf("JSON set of Soviet key: got %d, %+v; want a proxied response from shard 1", status, res)
+	}
+
+	status, res = getJSON(t, http.MethodGet, c.ts2.URL+"/get?key=Soviet&format=json", "")
+	if status != http.StatusOK || res.Value == nil || *res.Value != "Moscow" || res.Proxied {
+		t.Errorf("JSON get of Soviet key: got %d, %+v; want value %q", status, res, "Moscow")
+	}
+
+	if status, body := doRequest(t, http.MethodPut, c.ts2.URL+"/v1/keys/Soviet", "\xff\x00"); status != http.StatusNoContent {
+		t.Fatalf("PUT binary value: got status %d (%q), want %d", status, body, http.StatusNoContent)
+	}
+
+	status, res = getJSON(t, http.MethodGet, c.ts2.URL+"/v1/keys/Soviet?format=json", "")
+	if status != http.StatusOK || res.Value != nil || res.ValueBase64 != "/wA=" {
+		t.Errorf("JSON get of binary value: got %d, %+v; want value_base64 %q", status, res, "/wA=")
+	}
+
+	status, res = getJSON(t, http.MethodGet, c.ts1.URL+"/v1/keys/USA?format=json", "")
+	if status != http.StatusNotFound || res.Error == nil || res.Error.Code != web.CodeNotFound {
+		t.Errorf("JSON get of missing USA key: got %d, %+v; want %q error", status, res, web.CodeNotFound)
+	}
+
+	status, res = getJSON(t, http.MethodGet, c.ts1.URL+"/get?key=USA&consistency=unknown&format=json", "")
+	if status != http.StatusBadRequest || res.Error == nil || res.Error.Code != web.CodeBadRequest {
+		t.Errorf("JSON get with unknown consistency: got %d, %+v; want %q error", status, res, web.CodeBadRequest)
+	}
+
+	status, res = getJSON(t, http.MethodGet, c.ts2.URL+"/local-get?key=Soviet&format=json", "")
+	if status != http.StatusOK || res.ValueBase64 != "/wA=" {
+		t.Errorf("JSON local get of Soviet key: got %d, %+v; want value_base64 %q", status, res, "/wA=")
+	}
+
+	status, res = getJSON(t, http.MethodGet, c.ts1.URL+"/local-get?key=Soviet&format=json", "")
+	if status != http.StatusNotFound || res.Error == nil || res.Error.Code != web.CodeNotFound {
+		t.Errorf("JSON local get of Soviet key from another shard: got %d, %+v; want %q error", status, res, web.CodeNotFound)
+	}
+}
+
+func TestSetValueFromBody(t *testing.T) { forEachEngine(t, testSetValueFromBody) }
+
+func testSetValueFromBody(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+	c.web2.MaxValueSize = 8
+
+	// The body is forwarded to the second shard that owns "Soviet".
+	value := "\xff\x00\n&="
+	if status, body := doRequest(t, http.MethodPost, c.ts1.URL+"/set?key=Soviet", value); status != http.StatusOK {
+		t.Fatalf("POST /set with the value in the body: got status %d (%q), want %d", status, body, http.StatusOK)
+	}
+
+	if got, err := c.db2.GetKey("Soviet"); err != nil || string(got) != value {
+		t.Errorf("Soviet key: got %q, %v; want %q, nil", got, err, value)
+	}
+
+	if status, body := doRequest(t, http.MethodPut, c.ts1.URL+"/v1/keys/Soviet", "too large value"); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT of a value larger than the limit: got status %d (%q), want %d", status, body, http.StatusRequestEntityTooLarge)
+	}
+
+	if got, err := c.db2.GetKey("Soviet"); err != nil || string(got) != value {
+		t.Errorf("Soviet key after the rejected write: got %q, %v; want %q, nil", got, err, value)
+	}
+}
+
+func TestSetFormBody(t *testing.T) { forEachEngine(t, testSetFormBody) }
+
+func testSetFormBody(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	// curl --data-binary sends the value with the form Content-Type.
+	value := "\xff\x00key=Kremlin&value=+%41"
+	for _, u := range []string{c.ts1.URL, c.ts2.URL} {
+		resp, err := http.Post(u+"/set?key=Soviet", "application/x-www-form-urlencoded", strings.NewReader(value))
+		if err != nil {
+			t.Fatalf("POST /set failed: %v", err)
+		}
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(contents), "Error = <nil>") {
+			t.Errorf("POST %s/set with the form Content-Type: got %d, %q; want %d", u, resp.StatusCode, contents, http.StatusOK)
+		}
+
+		if got, err := c.db2.GetKey("Soviet"); err != nil || string(got) != value {
+			t.Errorf("Soviet key after POST to %s: got %q, %v; want %q, nil", u, got, err, value)
+		}
+		if err := c.db2.DeleteKey("Soviet"); err != nil {
+			t.Fatalf("DeleteKey(Soviet): %v", err)
+		}
+	}
+
+	if got, err := c.db2.GetKey("Kremlin"); err != nil || got != nil {
+		t.Errorf("Kremlin key from the body: got %q, %v; want nil, nil", got, err)
+	}
+}
+
+func TestFormRequests(t *testing.T) { forEachEngine(t, testFormRequests) }
+
+func testFormRequests(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	post := func(u, form string) {
+		t.Helper()
+
+		resp, err := http.Post(u, "application/x-www-form-urlencoded", strings.NewReader(form))
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", u, err)
+		}
+		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(contents), "Error = <nil>") {
+			t.Errorf("POST %s with the form %q: got %d, %q; want %d", u, form, resp.StatusCode, contents, http.StatusOK)
+		}
+	}
+
+	// The form is forwarded to the second shard that owns "Soviet".
+	for _, u := range []string{c.ts1.URL, c.ts2.URL} {
+		post(u+"/set", "key=Soviet&value=Moscow")
+		if got, err := c.db2.GetKey("Soviet"); err != nil || string(got) != "Moscow" {
+			t.Errorf("Soviet key after the form POST to %s/set: got %q, %v; want %q, nil", u, got, err, "Moscow")
+		}
+
+		post(u+"/delete", "key=Soviet")
+		if got, err := c.db2.GetKey("Soviet"); err != nil || got != nil {
+			t.Errorf("Soviet key after the form POST to %s/delete: got %q, %v; want nil, nil", u, got, err)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) { forEachEngine(t, testProxy) }
+
+func testProxy(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	if status, contents := doRequest(t, http.MethodPost, c.ts1.URL+"/set?key=Soviet&value=Moscow", ""); status != http.StatusOK || !strings.HasPrefix(contents, "Error = <nil>") {
+		t.Errorf("POST /set through the proxy: got %d, %q; want %d without the redirect banner", status, contents, http.StatusOK)
+	}
+
+	if got, err := c.db2.GetKey("Soviet"); err != nil || string(got) != "Moscow" {
+		t.Errorf("Soviet key: got %q, %v; want %q, nil", got, err, "Moscow")
+	}
+
+	status, res := getJSON(t, http.MethodGet, c.ts1.URL+"/v1/keys/Soviet?format=json", "")
+	if status != http.StatusOK || !res.Proxied || res.Value == nil || *res.Value != "Moscow" {
+		t.Errorf("JSON get through the proxy: got %d, %+v; want proxied value %q", status, res, "Moscow")
+	}
+}
+
+func TestProxyLoop(t *testing.T) { forEachEngine(t, testProxyLoop) }
+
+func testProxyLoop(t *testing.T, engine db.Engine) {
+	ts := httptest.NewServer(nil)
+	defer ts.Close()
+
+	// The node believes that "Soviet" belongs to another shard with its own address.
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	_, srv := createShardServer(t, engine, 0, map[int]string{0: addr, 1: addr})
+	ts.Config.Handler = newMux(srv)
+
+	status, res := getJSON(t, http.MethodGet, ts.URL+"/get?key=Soviet&format=json", "")
+	if status != http.StatusLoopDetected || res.Error == nil || res.Error.Code != web.CodeLoopDetected {
+		t.Errorf("Request in a routing loop: got %d, %+v; want %d with %q error", status, res, http.StatusLoopDetected, web.CodeLoopDetected)
+	}
+}
+
+func TestRedirectRouting(t *testing.T) { forEachEngine(t, testRedirectRouting) }
+
+func testRedirectRouting(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+	c.web1.DefaultRouting = web.RoutingRedirect
+
+	// The client follows the redirect to the owner of "Soviet" and sends the body again.
+	if status, body := doRequest(t, http.MethodPut, c.ts1.URL+"/v1/keys/Soviet", "Moscow"); status != http.StatusNoContent {
+		t.Fatalf("PUT with redirect routing: got status %d (%q), want %d", status, body, http.StatusNoContent)
+	}
+
+	if got, err := c.db2.GetKey("Soviet"); err != nil || string(got) != "Moscow" {
+		t.Errorf("Soviet key: got %q, %v; want %q, nil", got, err, "Moscow")
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(c.ts1.URL + "/get?key=Soviet&format=json")
+	if err != nil {
+		t.Fatalf("GET with redirect routing failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var res web.Response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Could not decode the moved response: %v", err)
+	}
+
+	wantLocation := c.ts2.URL + "/get?consistency=leader&format=json&key=Soviet"
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != wantLocation {
+		t.Errorf("GET with redirect routing: got %d to %q, want %d to %q", resp.StatusCode, resp.Header.Get("Location"), http.StatusTemporaryRedirect, wantLocation)
+	}
+	if res.Error == nil || res.Error.Code != web.CodeMoved || res.Shard == nil || *res.Shard != 1 || res.Owner != c.addrs[1] {
+		t.Errorf("Moved response: got %+v, want shard 1 at %q", res, c.addrs[1])
+	}
+
+	// The routing can be overridden per request.
+	if got := getBody(t, c.ts1.URL+"/get?key=Soviet&routing=proxy"); !strings.Contains(got, "Moscow") {
+		t.Errorf("GET with proxy routing: got %q, want the value %q", got, "Moscow")
+	}
+}
+
+func TestBatch(t *testing.T) { forEachEngine(t, testBatch) }
+
+func testBatch(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	moscow := "Moscow"
+	status, body := doRequest(t, http.MethodPost, c.ts1.URL+"/v1/batch/set", `{"items": [
+		{"key": "Soviet", "value": "Moscow"},
+		{"key": "USA", "value_base64": "/wA="},
+		{"key": "Moscow", "value": "Russia"}
+	]}`)
+	if status != http.StatusOK {
+		t.Fatalf("Batch set: got status %d (%q), want %d", status, body, http.StatusOK)
+	}
+
+	var res web.BatchResponse
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatalf("Could not decode the batch set response %q: %v", body, err)
+	}
+	for _, r := range res.Results {
+		if r.Error != nil {
+			t.Errorf("Batch set of key %q: got error %+v", r.Key, r.Error)
+		}
+	}
+
+	if got, err := c.db1.GetKey("USA"); err != nil || string(got) != "\xff\x00" {
+		t.Errorf("USA key: got %q, %v; want %q, nil", got, err, "\xff\x00")
+	}
+	if got, err := c.db2.GetKey("Soviet"); err != nil || string(got) != moscow {
+		t.Errorf("Soviet key: got %q, %v; want %q, nil", got, err, moscow)
+	}
+
+	status, body = doRequest(t, http.MethodPost, c.ts2.URL+"/v1/batch/get", `{"keys": ["USA", "missing", "Soviet"]}`)
+	if status != http.StatusOK {
+		t.Fatalf("Batch get: got status %d (%q), want %d", status, body, http.StatusOK)
+	}
+
+	res = web.BatchResponse{}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatalf("Could not decode the batch get response %q: %v", body, err)
+	}
+
+	if len(res.Results) != 3 {
+		t.Fatalf("Batch get: got %d results, want %d", len(res.Results), 3)
+	}
+	if r := res.Results[0]; r.Key != "USA" || r.ValueBase64 != "/wA=" || !r.Proxied || r.Node != c.addrs[0] {
+		t.Errorf("Batch get of USA key: got %+v, want a proxied binary value from shard 0", r)
+	}
+	if r := res.Results[1]; r.Key != "missing" || r.Error == nil || r.Error.Code != web.CodeNotFound {
+		t.Errorf("Batch get of missing key: got %+v, want %q error", r, web.CodeNotFound)
+	}
+	if r := res.Results[2]; r.Key != "Soviet" || r.Value == nil || *r.Value != moscow || r.Proxied {
+		t.Errorf("Batch get of Soviet key: got %+v, want a local value %q", r, moscow)
+	}
+}
+
+func TestScan(t *testing.T) { forEachEngine(t, testScan) }
+
+func testScan(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		want = append(want, key)
+
+		status, body := doRequest(t, http.MethodPut, c.ts1.URL+"/v1/keys/"+key, "value-"+key)
+		if status != http.StatusNoContent {
+			t.Fatalf("PUT %q: got status %d (%q), want %d", key, status, body, http.StatusNoContent)
+		}
+	}
+
+	// The keys that have not been purged after resharding are returned only once.
+	if err := c.db1.SetKey("key-extra", []byte("stale")); err != nil {
+		t.Fatalf("SetKey() failed: %v", err)
+	}
+	if err := c.db2.SetKey("key-extra", []byte("stale")); err != nil {
+		t.Fatalf("SetKey() failed: %v", err)
+	}
+	want = append(want, "key-extra")
+
+	// The keys that have not been moved to their owner yet are returned
+	// from the previous owner.
+	moving := c.db1
+	if (&config.Shards{Count: 2}).Index("key-moving") == 0 {
+		moving = c.db2
+	}
+	if err := moving.SetKey("key-moving", []byte("value-key-moving")); err != nil {
+		t.Fatalf("SetKey() failed: %v", err)
+	}
+	want = append(want, "key-moving")
+
+	if err := c.db1.SetKey("other", []byte("value")); err != nil {
+		t.Fatalf("SetKey() failed: %v", err)
+	}
+
+	var got []string
+	token := ""
+	for page := 0; page < 10; page++ {
+		status, body := doRequest(t, http.MethodGet, c.ts2.URL+"/v1/scan?prefix=key-&limit=3&token="+token, "")
+		if status != http.StatusOK {
+			t.Fatalf("Scan: got status %d (%q), want %d", status, body, http.StatusOK)
+		}
+
+		var res web.ScanResponse
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatalf("Could not decode the scan response %q: %v", body, err)
+		}
+
+		for _, r := range res.Results {
+			if r.Key != "key-extra" && (r.Value == nil || *r.Value != "value-"+r.Key) {
+				t.Errorf("Scan result for key %q: got %+v, want value %q", r.Key, r, "value-"+r.Key)
+			}
+			got = append(got, r.Key)
+		}
+
+		if res.Next == "" {
+			break
+		}
+		token = res.Next
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan of all pages: got %q, want %q", got, want)
+	}
+}
+
+func TestScanLocalConsistency(t *testing.T) { forEachEngine(t, testScanLocalConsistency) }
+
+func testScanLocalConsistency(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+	if err := c.db2.SetKey("Soviet", []byte("leader-value")); err != nil {
+		t.Fatalf("SetKey() on leader failed: %v", err)
+	}
+
+	// The replica of the second shard has never heard from its leader.
+	replicaDb := createShardDb(t, engine, 1)
+	if err := replicaDb.SetKey("Soviet", []byte("replica-value")); err != nil {
+		t.Fatalf("SetKey() on replica failed: %v", err)
+	}
+	srv := web.NewServer(replicaDb, &config.Shards{Addrs: c.addrs, Count: 2, CurIdx: 1})
+	srv.Replication = replication.NewClient(replicaDb, c.addrs[1], "replica", 0)
+	ts := httptest.NewServer(newMux(srv))
+	defer ts.Close()
+
+	for query, want := range map[string]string{
+		"consistency=any": "replica-value",
+		"consistency=bounded-staleness&max-staleness=1m": "leader-value",
+		"consistency=leader":                             "leader-value",
+	} {
+		status, body := doRequest(t, http.MethodGet, ts.URL+"/v1/scan?scope=local&"+query, "")
+		if status != http.StatusOK {
+			t.Fatalf("Local scan with %q: got status %d (%q), want %d", query, status, body, http.StatusOK)
+		}
+
+		var res web.ScanResponse
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatalf("Could not decode the scan response %q: %v", body, err)
+		}
+		if len(res.Results) != 1 || res.Results[0].Value == nil || *res.Results[0].Value != want {
+			t.Errorf("Local scan with %q: got %+v, want the value %q", query, res.Results, want)
+		}
+	}
+}
+
+func TestConditionalWrites(t *testing.T) { forEachEngine(t, testConditionalWrites) }
+
+func testConditionalWrites(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	// The requests for "Soviet" are proxied to the second shard with the headers.
+	url := c.ts1.URL + "/v1/keys/Soviet"
+
+	doConditional := func(method, body, header, value string) (int, http.Header) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest(%q, %q) failed: %v", method, url, err)
+		}
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %q failed: %v", method, url, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header
+	}
+
+	if status, _ := doConditional(http.MethodPut, "Moscow", "If-None-Match", "*"); status != http.StatusNoContent {
+		t.Fatalf("PUT with If-None-Match for a missing key: got status %d, want %d", status, http.StatusNoContent)
+	}
+	if status, _ := doConditional(http.MethodPut, "Leningrad", "If-None-Match", "*"); status != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with If-None-Match for an existing key: got status %d, want %d", status, http.StatusPreconditionFailed)
+	}
+
+	_, h := doConditional(http.MethodGet, "", "", "")
+	etag := h.Get("ETag")
+	if etag == "" {
+		t.Fatalf("GET did not return the ETag")
+	}
+
+	if status, _ := doConditional(http.MethodPut, "Leningrad", "If-Match", etag); status != http.StatusNoContent {
+		t.Fatalf("PUT with the current ETag: got status %d, want %d", status, http.StatusNoContent)
+	}
+	if status, _ := doConditional(http.MethodDelete, "", "If-Match", etag); status != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with a stale ETag: got status %d, want %d", status, http.StatusPreconditionFailed)
+	}
+
+	status, res := getJSON(t, http.MethodGet, c.ts1.URL+"/set?key=Soviet&value=Moscow&if-value=Kiev&format=json", "")
+	if status != http.StatusPreconditionFailed || res.Error == nil || res.Error.Code != web.CodeConditionFailed {
+		t.Errorf("Set with a different if-value: got %d, %+v; want %q error", status, res, web.CodeConditionFailed)
+	}
+
+	status, res = getJSON(t, http.MethodGet, c.ts1.URL+"/set?key=Soviet&value=Moscow&if-value=Leningrad&format=json", "")
+	if status != http.StatusOK || res.Error != nil {
+		t.Errorf("Set with the current if-value: got %d, %+v; want success", status, res)
+	}
+
+	if status, body := doRequest(t, http.MethodGet, url, ""); status != http.StatusOK || body != "Moscow" {
+		t.Errorf("GET after conditional writes: got %d, %q; want %d, %q", status, body, http.StatusOK, "Moscow")
+	}
+}
+
+func TestKeyMeta(t *testing.T) { forEachEngine(t, testKeyMeta) }
+
+func testKeyMeta(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	url := c.ts1.URL + "/v1/keys/Soviet"
+
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader("<p>Moscow</p>"))
+	if err != nil {
+		t.Fatalf("NewRequest() failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/html")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT %q failed: %v", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("ETag") != `"1"` {
+		t.Fatalf("PUT %q: got %d with ETag %q, want %d with ETag %q", url, resp.StatusCode, resp.Header.Get("ETag"), http.StatusNoContent, `"1"`)
+	}
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %q failed: %v", url, err)
+	}
+	resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html" {
+		t.Errorf("GET %q: got Content-Type %q, want %q", url, ct, "text/html")
+	}
+	if etag := resp.Header.Get("ETag"); etag != `"1"` {
+		t.Errorf("GET %q: got ETag %q, want %q", url, etag, `"1"`)
+	}
+	if _, err := http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+		t.Errorf("GET %q: invalid Last-Modified %q: %v", url, resp.Header.Get("Last-Modified"), err)
+	}
+
+	status, res := getJSON(t, http.MethodGet, url+"?format=json", "")
+	if status != http.StatusOK || res.Version != 1 || res.ContentType != "text/html" || res.Modified == nil {
+		t.Errorf("JSON GET %q: got %d, %+v; want version 1 with the metadata", url, status, res)
+	}
+}
+
+func TestExpiration(t *testing.T) { forEachEngine(t, testExpiration) }
+
+func testExpiration(t *testing.T, engine db.Engine) {
+	ts := httptest.NewServer(nil)
+	defer ts.Close()
+
+	_, web1 := createShardServer(t, engine, 0, map[int]string{0: strings.TrimPrefix(ts.URL, "http://")})
+	ts.Config.Handler = newMux(web1)
+
+	url := ts.URL + "/v1/keys/Soviet"
+
+	if status, _ := doRequest(t, http.MethodPut, url+"?ttl=-1s", "Moscow"); status != http.StatusBadRequest {
+		t.Errorf("PUT with a negative ttl: got status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	status, res := getJSON(t, http.MethodPut, url+"?ttl=50ms&format=json", "Moscow")
+	if status != http.StatusOK || res.Expires == nil {
+		t.Fatalf("JSON PUT with ttl: got %d, %+v; want %d with the expiration time", status, res, http.StatusOK)
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %q failed: %v", url, err)
+	}
+	resp.Body.Close()
+
+	if _, err := http.ParseTime(resp.Header.Get("Expires")); err != nil {
+		t.Errorf("GET %q: invalid Expires %q: %v", url, resp.Header.Get("Expires"), err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if status, _ := doRequest(t, http.MethodGet, url, ""); status != http.StatusNotFound {
+		t.Errorf("GET after expiration: got status %d, want %d", status, http.StatusNotFound)
+	}
+
+	if got := getBody(t, ts.URL+"/set?key=USA&value=Washington&ttl=1ms"); !strings.Contains(got, "Error = <nil>") {
+		t.Errorf("/set with ttl: got %q, want no error", got)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if status, _ := doRequest(t, http.MethodGet, ts.URL+"/v1/keys/USA", ""); status != http.StatusNotFound {
+		t.Errorf("GET after expiration: got status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestIncrement(t *testing.T) { forEachEngine(t, testIncrement) }
+
+func testIncrement(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	const workers = 10
+
+	// The increments are routed to the owners of the keys and none of them are lost.
+	for _, key := range []string{"Soviet", "USA"} {
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				resp, err := http.Get(c.ts1.URL + "/incr?key=" + key + "&delta=2")
+				if err != nil {
+					t.Errorf("Increment of %q failed: %v", key, err)
+					return
+				}
+				resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+
+		want := strconv.Itoa(2 * workers)
+		if got := getBody(t, c.ts2.URL+"/get?key="+key); !strings.Contains(got, fmt.Sprintf("Value = %q", want)) {
+			t.Errorf("Get(%q) after the increments: got %q, want value %q", key, got, want)
+		}
+
+		status, res := getJSON(t, http.MethodPost, c.ts2.URL+"/incr?format=json&key="+key+"&delta=-1", "")
+		if want := strconv.Itoa(2*workers - 1); status != http.StatusOK || res.Value == nil || *res.Value != want {
+			t.Errorf("JSON increment of %q: got %d, %+v; want value %q", key, status, res, want)
+		}
+	}
+
+	getBody(t, c.ts1.URL+"/set?key=Soviet&value=Moscow")
+
+	status, res := getJSON(t, http.MethodPost, c.ts1.URL+"/incr?format=json&key=Soviet", "")
+	if status != http.StatusConflict || res.Error == nil || res.Error.Code != web.CodeNotInteger {
+		t.Errorf("JSON increment of a string: got %d, %+v; want %d with code %q", status, res, http.StatusConflict, web.CodeNotInteger)
+	}
+
+	if status, _ := doRequest(t, http.MethodPost, c.ts1.URL+"/incr?key=Soviet&delta=one", ""); status != http.StatusBadRequest {
+		t.Errorf("Increment with an invalid delta: got status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestNamespaces(t *testing.T) { forEachEngine(t, testNamespaces) }
+
+func testNamespaces(t *testing.T, engine db.Engine) {
+	c := newTestCluster(t, engine)
+
+	if status, body := doRequest(t, http.MethodPut, c.ts1.URL+"/v1/namespaces/team", ""); status != http.StatusOK {
+		t.Fatalf("Creating a namespace: got %d (%q), want %d", status, body, http.StatusOK)
+	}
+
+	for i, d := range []*db.Database{c.db1, c.db2} {
+		if names, err := d.Namespaces(); err != nil || !reflect.DeepEqual(names, []string{"team"}) {
+			t.Errorf("Namespaces() on shard %d: got %q, %v; want %q", i, names, err, []string{"team"})
+		}
+	}
+
+	if status, _ := doRequest(t, http.MethodPut, c.ts1.URL+"/v1/namespaces/bad%20name", ""); status != http.StatusBadRequest {
+		t.Errorf("Creating an invalid namespace: got status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	keys := []string{"Soviet", "USA", "Moscow", "Washington"}
+	for _, key := range keys {
+		if status, _ := doRequest(t, http.MethodPut, c.ts1.URL+"/v1/keys/"+key+"?ns=team", "team-"+key); status != http.StatusNoContent {
+			t.Errorf("PUT %q in namespace %q: got status %d, want %d", key, "team", status, http.StatusNoContent)
+		}
+	}
+
+	for _, key := range keys {
+		if status, body := doRequest(t, http.MethodGet, c.ts2.URL+"/v1/keys/"+key+"?ns=team", ""); status != http.StatusOK || body != "team-"+key {
+			t.Errorf("GET %q in namespace %q: got %d, %q; want %d, %q", key, "team", status, body, http.StatusOK, "team-"+key)
+		}
+		if status, _ := doRequest(t, http.MethodGet, c.ts2.URL+"/v1/keys/"+key, ""); status != http.StatusNotFound {
+			t.Errorf("GET %q in the default namespace: got status %d, want %d", key, status, http.StatusNotFound)
+		}
+	}
+
+	status, res := getJSON(t, http.MethodGet, c.ts1.URL+"/v1/keys/Soviet?format=json&ns=missing", "")
+	if status != http.StatusNotFound || res.Error == nil || res.Error.Code != web.CodeNoNamespace {
+		t.Errorf("GET in a missing namespace: got %d, %+v; want %d with code %q", status, res, http.StatusNotFound, web.CodeNoNamespace)
+	}
+
+	var scan web.ScanResponse
+	if err := json.Unmarshal([]byte(getBody(t, c.ts2.URL+"/v1/scan?ns=team")), &scan); err != nil || len(scan.Results) != len(keys) {
+		t.Errorf("Scan of namespace %q: got %+v, %v; want %d keys", "team", scan, err, len(keys))
+	}
+
+	if status, body := doRequest(t, http.MethodDelete, c.ts2.URL+"/v1/namespaces/team", ""); status != http.StatusOK {
+		t.Fatalf("Deleting a namespace: got %d (%q), want %d", status, body, http.StatusOK)
+	}
+
+	var list web.NamespacesResponse
+	if err := json.Unmarshal([]byte(getBody(t, c.ts1.URL+"/v1/namespaces")), &list); err != nil || len(list.Namespaces) != 0 {
+		t.Errorf("Namespaces after the deletion: got %+v, %v; want none", list, err)
+	}
 }